@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// serverBotLevel is how hard the bots the server fills the queue with
+// fight.
+const serverBotLevel = "normal"
+
+// botSecret lets the server's own bots in through the front door without
+// letting anyone else pose as one. It's set when the server starts.
+var botSecret string
+
+// isBotRequest reports whether a connection is one of our bots.
+func isBotRequest(secret string) bool {
+	return secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(botSecret)) == 1
+}
+
+// callBots sends a bot for everyone who has waited config.BotFill without
+// a match. Caller must hold lobbyMu.
+func callBots() {
+	for range botsDue(time.Now()) {
+		go runServerBot()
+	}
+}
+
+// botsDue marks everyone who has waited config.BotFill without a match as
+// calling a bot, once each, and returns how many it marked. Caller must
+// hold lobbyMu.
+func botsDue(now time.Time) int {
+	if config.BotFill <= 0 {
+		return 0
+	}
+	n := 0
+	for _, e := range queue {
+		if !e.botCalled && now.Sub(e.since) >= config.BotFill {
+			e.botCalled = true
+			n++
+		}
+	}
+	return n
+}
+
+// seatBot pairs an arriving bot with the longest-waiting player who called
+// one, reporting false if they've all found a match or left meanwhile.
+func seatBot(bot *Player) bool {
+	lobbyMu.Lock()
+	defer lobbyMu.Unlock()
+
+	var oldest *queueEntry
+	for _, e := range queue {
+		if e.botCalled && (oldest == nil || e.since.Before(oldest.since)) {
+			oldest = e
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	dequeue(oldest.player)
+	seatMatch(oldest.player, bot)
+	return true
+}
+
+// runServerBot connects a bot to this server like any other client, so it
+// plays by exactly the same rules, and keeps playing until its opponent
+// leaves.
+func runServerBot() {
+	c, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1"+serverAddr+"/?bot="+botSecret, nil)
+	if err != nil {
+		fmt.Println("Bot failed to connect:", err)
+		return
+	}
+	defer c.Close()
+
+	// Bots speak binary, the cheapest encoding for the server
+	first, useBinary, err := handshake(c, []string{encodingBinary, encodingJSON})
+	if err != nil {
+		fmt.Println("Bot refused:", err)
+		return
+	}
+	msgs := make(chan interface{}, 32)
+	msgs <- first
+	go func() {
+		defer close(msgs)
+		for {
+			msg, err := readMessage(c)
+			if err != nil {
+				return
+			}
+			msgs <- msg
+		}
+	}()
+
+	brain := botBrain{level: botLevels[serverBotLevel]}
+	var me fighter
+	var enemyX, enemyY int
+	var seq uint32
+	playing := false
+
+	ticker := time.NewTicker(tickRate)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			switch msg := msg.(type) {
+			case RoundStart:
+				facing := 'd'
+				if !msg.Player1 {
+					facing = 'a'
+				}
+				me.spawn(msg.X, facing)
+				me.y = msg.Y
+				enemyX, enemyY = msg.EnemyX, msg.EnemyY
+				brain.seen = nil
+				playing = true
+			case StateAck:
+				// The server has the final say on where we are
+				me.x, me.y = msg.X, msg.Y
+			case MatchResult:
+				playing = false
+				if msg.SeriesOver {
+					writeEncoded(c, RematchRequest{Accept: true}, useBinary)
+				}
+			case RematchDeclined, ErrorMessage:
+				return
+			case RemoteState:
+				enemyX, enemyY = msg.X, msg.Y
+			}
+
+		case now := <-ticker.C:
+			if !playing {
+				continue
+			}
+			x, y, facing := me.x, me.y, me.facing
+			attack := brain.decide(now, &me, enemyX, enemyY)
+			if attack {
+				me.lastAttack = now
+			}
+			if attack || me.x != x || me.y != y || me.facing != facing {
+				seq++
+				writeEncoded(c, RemoteState{Seq: seq, X: me.x, Y: me.y, Attack: attack, Facing: me.facing}, useBinary)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBotsDue(t *testing.T) {
+	tests := []struct {
+		name    string
+		botFill time.Duration
+		waits   []time.Duration
+		called  []bool // already called a bot
+		want    int
+	}{
+		{"bot fill off", 0, []time.Duration{time.Hour}, []bool{false}, 0},
+		{"not waited long enough", 10 * time.Second, []time.Duration{5 * time.Second}, []bool{false}, 0},
+		{"waited long enough", 10 * time.Second, []time.Duration{10 * time.Second}, []bool{false}, 1},
+		{"only those due", 10 * time.Second, []time.Duration{time.Second, 20 * time.Second, 30 * time.Second}, []bool{false, false, false}, 2},
+		{"bot already on its way", 10 * time.Second, []time.Duration{20 * time.Second}, []bool{true}, 0},
+	}
+	savedQueue, savedConfig := queue, config
+	defer func() { queue, config = savedQueue, savedConfig }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = ServerConfig{BotFill: tt.botFill}
+			now := time.Now()
+			queue = nil
+			for i, wait := range tt.waits {
+				e := queued("", defaultRating, 0)
+				e.since, e.botCalled = now.Add(-wait), tt.called[i]
+				queue = append(queue, e)
+			}
+			if got := botsDue(now); got != tt.want {
+				t.Errorf("botsDue = %d, want %d", got, tt.want)
+			}
+			if again := botsDue(now); again != 0 {
+				t.Errorf("second botsDue called %d more bots, want none", again)
+			}
+		})
+	}
+}
+
+// newTestBot makes a server bot with a queue the tests can leave undrained.
+func newTestBot() *Player {
+	return &Player{
+		bot:    true,
+		rating: defaultRating,
+		send:   make(chan frame, playerQueueSize),
+		done:   make(chan struct{}),
+	}
+}
+
+func TestSeatBot(t *testing.T) {
+	savedQueue, savedLobbies, savedConfig := queue, lobbies, config
+	defer func() { queue, lobbies, config = savedQueue, savedLobbies, savedConfig }()
+	config = ServerConfig{BestOf: 1}
+
+	waiting, newer, uncalled := queued("alice", 1500, 20*time.Second), queued("bob", 1500, 15*time.Second), queued("carol", 1500, time.Hour)
+	waiting.botCalled, newer.botCalled = true, true
+	queue = []*queueEntry{newer, uncalled, waiting}
+
+	bot := newTestBot()
+	if !seatBot(bot) {
+		t.Fatal("bot wasn't seated")
+	}
+	l := bot.Lobby
+	if l == nil || waiting.player.Lobby != l {
+		t.Fatal("bot wasn't seated with the longest-waiting player who called it")
+	}
+	if l.Round != 1 || l.MatchEnded {
+		t.Errorf("seating a bot didn't start the fight: round %d, ended %v", l.Round, l.MatchEnded)
+	}
+	if len(queue) != 2 {
+		t.Errorf("%d players still queued, want 2", len(queue))
+	}
+
+	// carol never called a bot, so bob gets the next and there's none after
+	if !seatBot(newTestBot()) || newer.player.Lobby == nil {
+		t.Error("second bot wasn't seated with bob")
+	}
+	if seatBot(newTestBot()) {
+		t.Error("a bot was seated with nobody waiting for one")
+	}
+	if uncalled.player.Lobby != nil {
+		t.Error("a bot was seated with a player who never called one")
+	}
+}
+
+func TestBotWinsUnscored(t *testing.T) {
+	savedRatings := ratings
+	defer func() { ratings = savedRatings }()
+	ratings = &memoryRatings{}
+
+	for _, humanWins := range []bool{true, false} {
+		l, human, bot := fightingPair()
+		human.name, human.rating = "alice", 1500
+		bot.bot, bot.rating = true, defaultRating
+		winner, loser := human, bot
+		if !humanWins {
+			winner, loser = bot, human
+		}
+
+		l.mu.Lock()
+		endRound(l, winner, loser, false)
+		l.mu.Unlock()
+
+		if human.rating != 1500 {
+			t.Errorf("human won=%v: rating moved to %d against a bot", humanWins, human.rating)
+		}
+		if winner.scoreToken != "" {
+			t.Errorf("human won=%v: winner was issued a high score token against a bot", humanWins)
+		}
+		for _, r := range sentResults(t, human) {
+			if r.Token != "" || r.RatingChange != 0 {
+				t.Errorf("human won=%v: told %+v, want no token or rating change", humanWins, r)
+			}
+		}
+	}
+}
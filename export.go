@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Casts are recorded at the arena's size plus the status line, whatever
+// the player's terminal is.
+const (
+	castWidth  = arenaRight + 2
+	castHeight = arenaBottom + 2
+)
+
+// castWriter writes an asciinema v2 .cast file: a JSON header line, then
+// one [seconds, "o", data] line per frame. Each frame redraws the whole
+// screen, and frames identical to the last one are skipped.
+type castWriter struct {
+	file  *os.File
+	buf   *bufio.Writer
+	start time.Time // for live casts, when recording began
+	last  string
+}
+
+func newCastWriter(path, title string) (*castWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &castWriter{file: file, buf: bufio.NewWriter(file), start: time.Now()}
+	header := map[string]interface{}{
+		"version":   2,
+		"width":     castWidth,
+		"height":    castHeight,
+		"timestamp": time.Now().Unix(),
+		"title":     title,
+	}
+	if err := json.NewEncoder(c.buf).Encode(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// capture records what s currently shows as the frame at offset at.
+func (c *castWriter) capture(s tcell.Screen, at time.Duration) {
+	frame := renderANSI(s)
+	if frame == c.last {
+		return
+	}
+	c.last = frame
+	line, _ := json.Marshal([]interface{}{at.Seconds(), "o", frame})
+	c.buf.Write(append(line, '\n'))
+}
+
+func (c *castWriter) Close() error {
+	if err := c.buf.Flush(); err != nil {
+		c.file.Close()
+		return err
+	}
+	return c.file.Close()
+}
+
+// renderANSI turns the screen's contents into terminal output that clears
+// the screen and redraws it, changing colors only where the style changes.
+func renderANSI(s tcell.Screen) string {
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	w, h := s.Size()
+	for y := 0; y < min(h, castHeight); y++ {
+		if y > 0 {
+			b.WriteString("\r\n")
+		}
+		var current tcell.Style
+		b.WriteString("\x1b[0m")
+		for x := 0; x < min(w, castWidth); x++ {
+			str, style, width := s.Get(x, y)
+			if style != current {
+				b.WriteString(sgr(style))
+				current = style
+			}
+			if str == "" {
+				str = " "
+			}
+			b.WriteString(str)
+			if width > 1 {
+				x += width - 1
+			}
+		}
+	}
+	b.WriteString("\x1b[0m")
+	return b.String()
+}
+
+// sgr is the escape sequence that switches the terminal to style.
+func sgr(style tcell.Style) string {
+	fg, bg, attrs := style.Decompose()
+	codes := []string{"0"}
+	if attrs&tcell.AttrBold != 0 {
+		codes = append(codes, "1")
+	}
+	if fg != tcell.ColorDefault {
+		r, g, b := fg.RGB()
+		codes = append(codes, fmt.Sprintf("38;2;%d;%d;%d", r, g, b))
+	}
+	if bg != tcell.ColorDefault {
+		r, g, b := bg.RGB()
+		codes = append(codes, fmt.Sprintf("48;2;%d;%d;%d", r, g, b))
+	}
+	return "\x1b[" + strings.Join(codes, ";") + "m"
+}
+
+// exportReplay renders a replay frame by frame, at its own pace rather
+// than in real time, into a cast.
+func exportReplay(replayPath, castPath string) error {
+	header, events, err := readReplay(replayPath)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("%s is empty", replayPath)
+	}
+	cast, err := newCastWriter(castPath, "duel replay")
+	if err != nil {
+		return err
+	}
+
+	s := tcell.NewSimulationScreen("UTF-8")
+	if err := s.Init(); err != nil {
+		cast.Close()
+		return err
+	}
+	defer s.Fini()
+	s.SetSize(castWidth, castHeight)
+
+	rp := &replayPlayer{g: &Game{screen: s}, header: header, events: events, speed: 1, exporting: true}
+	rp.length = events[len(events)-1].T
+	rp.reset()
+	frame := tickRate.Milliseconds()
+	for t := int64(0); ; t += frame {
+		rp.seek(t)
+		rp.draw()
+		cast.capture(s, time.Duration(rp.pos)*time.Millisecond)
+		if rp.pos >= rp.length {
+			break
+		}
+	}
+	// Hold the final frame long enough to read the result
+	rp.seek(rp.length)
+	cast.last = ""
+	cast.capture(s, time.Duration(rp.length)*time.Millisecond+replayBannerTime)
+	return cast.Close()
+}
+
+// liveCast, when set, records every screen newScreen hands out, so a live
+// session can be exported as it's played.
+var liveCast *castWriter
+
+// castScreen is a screen that copies each frame it shows into liveCast.
+type castScreen struct {
+	tcell.Screen
+}
+
+func (c castScreen) Show() {
+	c.Screen.Show()
+	liveCast.capture(c.Screen, time.Since(liveCast.start))
+}
+
+// exportLive plays online as usual while recording the screen to a cast.
+func exportLive(server, castPath string) error {
+	cast, err := newCastWriter(castPath, "duel")
+	if err != nil {
+		return err
+	}
+	liveCast = cast
+	StartClient(server)
+	liveCast = nil
+	return cast.Close()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportReplay(t *testing.T) {
+	dir := t.TempDir()
+	replay, cast := filepath.Join(dir, "test.replay"), filepath.Join(dir, "test.cast")
+	writeReplay(t, replay, ReplayHeader{Source: "server", BestOf: 1}, testReplayEvents)
+	if err := exportReplay(replay, cast); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(cast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	lines := bufio.NewScanner(file)
+	lines.Buffer(nil, 1<<20)
+
+	if !lines.Scan() {
+		t.Fatal("cast is empty")
+	}
+	var header struct {
+		Version   int    `json:"version"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+		Timestamp int64  `json:"timestamp"`
+		Title     string `json:"title"`
+	}
+	if err := json.Unmarshal(lines.Bytes(), &header); err != nil {
+		t.Fatalf("header %q: %v", lines.Text(), err)
+	}
+	if header.Version != 2 || header.Width != castWidth || header.Height != castHeight || header.Timestamp == 0 || header.Title == "" {
+		t.Errorf("header = %+v, want asciicast v2 at %dx%d", header, castWidth, castHeight)
+	}
+
+	var times []float64
+	for lines.Scan() {
+		var event []interface{}
+		if err := json.Unmarshal(lines.Bytes(), &event); err != nil || len(event) != 3 {
+			t.Fatalf("event %q isn't [time, type, data]", lines.Text())
+		}
+		at, _ := event[0].(float64)
+		data, _ := event[2].(string)
+		if event[1] != "o" || !strings.HasPrefix(data, "\x1b[H\x1b[2J") {
+			t.Errorf("event at %gs is %v %q..., want a full-screen output frame", at, event[1], data[:min(len(data), 20)])
+		}
+		times = append(times, at)
+	}
+	if len(times) < 3 {
+		t.Fatalf("cast has %d frames, want one for each change in the fight", len(times))
+	}
+	if times[0] != 0 {
+		t.Errorf("first frame at %gs, want 0", times[0])
+	}
+	for i := 1; i < len(times); i++ {
+		if times[i] <= times[i-1] {
+			t.Errorf("frame %d at %gs doesn't come after frame %d at %gs", i, times[i], i-1, times[i-1])
+		}
+	}
+	// Frames fall on the replay's own ticks, however long exporting took,
+	// and the last holds the result up for replayBannerTime
+	length := testReplayEvents[len(testReplayEvents)-1].T
+	wantLast := float64(length)/1000 + replayBannerTime.Seconds()
+	if last := times[len(times)-1]; last < wantLast-0.001 || last > wantLast+0.001 {
+		t.Errorf("last frame at %gs, want %gs", last, wantLast)
+	}
+	for _, at := range times[:len(times)-1] {
+		ms := int64(at*1000 + 0.5)
+		if ms%tickRate.Milliseconds() != 0 && ms != length {
+			t.Errorf("frame at %gs isn't on a %v tick", at, tickRate)
+		}
+	}
+}
+
+func TestExportEmptyReplay(t *testing.T) {
+	dir := t.TempDir()
+	replay := filepath.Join(dir, "empty.replay")
+	writeReplay(t, replay, ReplayHeader{Source: "client"}, nil)
+	if err := exportReplay(replay, filepath.Join(dir, "empty.cast")); err == nil {
+		t.Error("exported an empty replay without complaint")
+	}
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"os"
 	"time"
+	"unicode"
 
 	"github.com/gdamore/tcell/v2"
 )
@@ -16,18 +17,32 @@ const (
 	arenaBottom = 23
 )
 
+// tickRate is how often the client simulates a frame. Movement is one cell
+// per axis per tick, which the server also enforces.
+const tickRate = 30 * time.Millisecond
+
+// Combat tuning, shared by the client and the server's hit resolution
+const (
+	attackCooldown     = 300 * time.Millisecond
+	hitInvulnerability = 300 * time.Millisecond
+	attackDamage       = 10
+
+	// cooldownSlack absorbs network jitter bunching up two attacks that
+	// were sent a full cooldown apart
+	cooldownSlack = 50 * time.Millisecond
+)
+
 type Game struct {
 	screen      tcell.Screen
 	PlayerX     int
 	PlayerY     int
 	hp          int
-	lastHit     time.Time
 	hitFlash    time.Time
 	playerColor tcell.Color
-	facing     rune // last direction: 'w', 'a', 's', 'd'
-	attacking  time.Time
-	lastAttack time.Time // for attack cooldown
-	isLeft     bool      // which side this player is on
+	facing      rune // last direction: 'w', 'a', 's', 'd'
+	attacking   time.Time
+	lastAttack  time.Time // for attack cooldown
+	isLeft      bool      // which side this player is on
 
 	enemyX         int
 	enemyY         int
@@ -39,26 +54,67 @@ type Game struct {
 	enemyConnected bool
 
 	totalPlayers int
+	roomCode     string    // private room code to show while waiting
+	identity     *Identity // local identity, nil when offline
+	playerName   string    // registered name; rated and used for high scores
+	rating       int
+	queued       bool // waiting in the rated matchmaking queue
+	enemyBot     bool // opponent is a server bot
+
+	reconnecting      bool // our connection dropped and we're winning it back
+	enemyReconnecting bool // the server is holding the opponent's seat
+
+	recorder *replayRecorder // DUEL_RECORD recording, nil when not recording
+	deferred []interface{}   // messages that arrived while the result screen waited on the server
+
+	// Best-of-N series state, from the server
+	round       int
+	bestOf      int
+	wins        int
+	enemyWins   int
+	roundBanner string // result of the last round, shown until the next starts
+
+	// Client-side prediction: states sent but not yet acknowledged
+	seq          uint32
+	pending      []pendingMove
+	sentX, sentY int // predicted position in the last state we sent
+
+	// Entity interpolation for the enemy, which is drawn slightly in the past
+	enemyBuf           snapshotBuffer
+	enemyDrawX         int
+	enemyDrawY         int
+	enemyExtrapolating bool
+	enemyBufDepth      int
+	showDebug          bool
 }
 
-func NewGame(isLeft bool) *Game {
+// newScreen sets up the terminal for drawing.
+func newScreen() tcell.Screen {
 	s, _ := tcell.NewScreen()
 	s.Init()
 	s.Clear()
-	
+	if liveCast != nil {
+		return castScreen{s}
+	}
+	return s
+}
+
+func NewGame(isLeft bool) *Game {
+	s := newScreen()
+
 	playerCol := tcell.ColorBlue
 	enemyCol := tcell.ColorRed
 	if !isLeft {
 		playerCol, enemyCol = enemyCol, playerCol
 	}
 	// Set initial enemy position and facing based on which side we're on
-	enemyX := 65 // enemy on right if we're on left
+	enemyX := 65        // enemy on right if we're on left
 	playerFacing := 'd' // face right if on left
 	enemyFacing := 'a'  // enemy faces left if on right
 	if !isLeft {
-		enemyX = 10          // enemy on left if we're on right
-		playerFacing = 'a'   // face left if on right
-		enemyFacing = 'd'    // enemy faces right if on left
+		enemyX = 10        // enemy on left if we're on right
+		playerFacing = 'a' // face left if on right
+		enemyFacing = 'd'  // enemy faces right if on left
 	}
 	return &Game{
 		screen:      s,
@@ -76,6 +132,13 @@ func NewGame(isLeft bool) *Game {
 	}
 }
 
+// Clamp a character's top-left cell to arena bounds (character is 2x2)
+func clampToArena(x, y int) (int, int) {
+	x = max(arenaLeft+1, min(x, arenaRight-2))
+	y = max(arenaTop+1, min(y, arenaBottom-2))
+	return x, y
+}
+
 // Check if attacker at (ax, ay) with sword facing 'facing' can hit target at (tx, ty)
 // Both characters are 2x2, sword extends 2 cells from attacker
 func canHit(ax, ay int, facing rune, tx, ty int) bool {
@@ -119,15 +182,6 @@ func canHit(ax, ay int, facing rune, tx, ty int) bool {
 	return xOverlap && yOverlap
 }
 
-func (g *Game) checkCollision(x, y int, facing rune) bool {
-	return canHit(x, y, facing, g.PlayerX, g.PlayerY)
-}
-
-// Check if we can hit the enemy from our position
-func (g *Game) canHitEnemy() bool {
-	return canHit(g.PlayerX, g.PlayerY, g.facing, g.enemyX, g.enemyY)
-}
-
 // Get sword position based on character position and facing direction
 // Sword appears next to top of 2x2 grid on the side they're facing
 func (g *Game) getSwordPosition(x, y int, facing rune) (int, int) {
@@ -145,6 +199,48 @@ func (g *Game) getSwordPosition(x, y int, facing rune) (int, int) {
 	}
 }
 
+// wasdKey reads a key press for the WASD player: a move as 'w', 'a', 's'
+// or 'd', ' ' to swing, or 0 for any other key.
+func wasdKey(ev *tcell.EventKey) rune {
+	if ev.Key() != tcell.KeyRune {
+		return 0
+	}
+	switch r := unicode.ToLower(ev.Rune()); r {
+	case 'w', 'a', 's', 'd', ' ':
+		return r
+	}
+	return 0
+}
+
+// arrowKey reads a key press for the arrow-key player the same way, with
+// Enter to swing.
+func arrowKey(ev *tcell.EventKey) rune {
+	switch ev.Key() {
+	case tcell.KeyUp:
+		return 'w'
+	case tcell.KeyDown:
+		return 's'
+	case tcell.KeyLeft:
+		return 'a'
+	case tcell.KeyRight:
+		return 'd'
+	case tcell.KeyEnter:
+		return ' '
+	}
+	return 0
+}
+
+// isQuitKey reports whether ev is Q, Escape or Ctrl-C.
+func isQuitKey(ev *tcell.EventKey) bool {
+	switch ev.Key() {
+	case tcell.KeyEscape, tcell.KeyCtrlC:
+		return true
+	case tcell.KeyRune:
+		return ev.Rune() == 'q' || ev.Rune() == 'Q'
+	}
+	return false
+}
+
 // Draw a 2-character sword based on facing direction
 func (g *Game) drawSword(x, y int, facing rune, style tcell.Style) {
 	switch facing {
@@ -166,7 +262,6 @@ func (g *Game) drawSword(x, y int, facing rune, style tcell.Style) {
 	}
 }
 
-
 // Little knight/warrior that faces the direction they're moving
 func (g *Game) drawCharacter(x, y int, facing rune, style tcell.Style) {
 	switch facing {
@@ -204,11 +299,12 @@ func (g *Game) drawCharacter(x, y int, facing rune, style tcell.Style) {
 	}
 }
 
-func (g *Game) Run(netChan <-chan RemoteState, matchResultChan <-chan MatchResult, sendMsg func(interface{})) {
-	ticker := time.NewTicker(30 * time.Millisecond)
+func (g *Game) Run(netChan <-chan RemoteState, msgChan <-chan interface{}, sendMsg func(interface{})) {
+	ticker := time.NewTicker(tickRate)
 	defer g.screen.Fini()
 	heartbeat := 150 * time.Millisecond
 	lastSend := time.Now()
+	g.sentX, g.sentY = g.PlayerX, g.PlayerY
 
 	// Track key states
 	keysHeld := make(map[rune]bool)
@@ -216,8 +312,9 @@ func (g *Game) Run(netChan <-chan RemoteState, matchResultChan <-chan MatchResul
 	stopInput := make(chan bool)
 
 	// Helper to send game state
-	sendState := func(st RemoteState) {
-		sendMsg(st)
+	sendState := func(attacking bool) {
+		g.sendState(sendMsg, attacking)
+		lastSend = time.Now()
 	}
 
 	// Channel for input events
@@ -247,32 +344,20 @@ func (g *Game) Run(netChan <-chan RemoteState, matchResultChan <-chan MatchResul
 
 	// Process input events
 	processGameInput := func(ev *tcell.EventKey) bool {
-		var key rune
-
-		switch ev.Key() {
-		case tcell.KeyRune:
-			r := ev.Rune()
-			// Normalize to lowercase for consistent handling
-			if r >= 'A' && r <= 'Z' {
-				r = r + 32 // convert to lowercase
-			}
-			if r == 'q' {
-				return true // quit
-			}
-			key = r
-		case tcell.KeyUp:
-			key = 'w'
-		case tcell.KeyDown:
-			key = 's'
-		case tcell.KeyLeft:
-			key = 'a'
-		case tcell.KeyRight:
-			key = 'd'
-		case tcell.KeyEscape, tcell.KeyCtrlC:
-			return true // quit
+		switch {
+		case isQuitKey(ev):
+			return true
+		case ev.Key() == tcell.KeyF3:
+			g.showDebug = !g.showDebug
 		}
 
-		if key != 0 {
+		// Online, the arrow keys move too
+		key := wasdKey(ev)
+		if key == 0 && arrowKey(ev) != ' ' {
+			key = arrowKey(ev)
+		}
+		// Hold still until the server has us back
+		if key != 0 && !g.reconnecting {
 			if key == ' ' {
 				attackPressed = true
 			} else {
@@ -282,8 +367,6 @@ func (g *Game) Run(netChan <-chan RemoteState, matchResultChan <-chan MatchResul
 		return false
 	}
 
-	attackCooldown := 300 * time.Millisecond
-
 	for {
 		select {
 		case ev := <-inputChan:
@@ -293,7 +376,7 @@ func (g *Game) Run(netChan <-chan RemoteState, matchResultChan <-chan MatchResul
 			}
 
 		case <-ticker.C:
-			oldX, oldY, oldHP := g.PlayerX, g.PlayerY, g.hp
+			oldX, oldY := g.PlayerX, g.PlayerY
 			step := 1
 			moved := false
 
@@ -325,19 +408,7 @@ func (g *Game) Run(netChan <-chan RemoteState, matchResultChan <-chan MatchResul
 			keysHeld['a'] = false
 			keysHeld['d'] = false
 
-			// Clamp to arena bounds (character is 2x2)
-			if g.PlayerX < arenaLeft+1 {
-				g.PlayerX = arenaLeft + 1
-			}
-			if g.PlayerX > arenaRight-2 {
-				g.PlayerX = arenaRight - 2
-			}
-			if g.PlayerY < arenaTop+1 {
-				g.PlayerY = arenaTop + 1
-			}
-			if g.PlayerY > arenaBottom-2 {
-				g.PlayerY = arenaBottom - 2
-			}
+			g.PlayerX, g.PlayerY = clampToArena(g.PlayerX, g.PlayerY)
 
 			// Handle attack with cooldown
 			attacking := false
@@ -345,95 +416,126 @@ func (g *Game) Run(netChan <-chan RemoteState, matchResultChan <-chan MatchResul
 				attacking = true
 				g.attacking = time.Now()
 				g.lastAttack = time.Now()
-				if g.canHitEnemy() {
-					g.enemyHitFlash = time.Now()
-				}
 			}
 			attackPressed = false
 
-			if moved || g.PlayerX != oldX || g.PlayerY != oldY || g.hp != oldHP || attacking {
-				sendState(RemoteState{
-					X:      g.PlayerX,
-					Y:      g.PlayerY,
-					HP:     g.hp,
-					Attack: attacking,
-					Facing: g.facing,
-				})
-				lastSend = time.Now()
+			if moved || g.PlayerX != oldX || g.PlayerY != oldY || attacking {
+				sendState(attacking)
 			}
 
 			// Heartbeat
 			if time.Since(lastSend) > heartbeat {
-				sendState(RemoteState{
-					X:      g.PlayerX,
-					Y:      g.PlayerY,
-					HP:     g.hp,
-					Attack: false,
-					Facing: g.facing,
-				})
-				lastSend = time.Now()
+				sendState(false)
 			}
 
+			g.updateEnemyRender(time.Now())
 			g.draw()
 
 		case st := <-netChan:
-			// Handle player count updates
-			if st.TotalPlayers > 0 {
-				g.totalPlayers = st.TotalPlayers
-			}
-
-			// Skip if this is just a player count message
-			if st.X == 0 && st.Y == 0 && st.HP == 0 {
-				continue
-			}
-
 			g.enemyConnected = true
 			g.enemyX = st.X
 			g.enemyY = st.Y
+			g.enemyBuf.push(time.Now(), st.X, st.Y)
 			g.enemyHP = st.HP
 			if st.Facing != 0 {
 				g.enemyFacing = st.Facing
 			}
-
-			// Enemy attacked - check if we got hit
 			if st.Attack {
 				g.enemyAttack = time.Now()
-				if time.Since(g.lastHit) > 300*time.Millisecond {
-					if g.checkCollision(g.enemyX, g.enemyY, g.enemyFacing) {
-						g.hp -= 10
-						g.hitFlash = time.Now()
-						g.lastHit = time.Now()
-						// Immediately send updated HP so attacker knows they hit
-						sendState(RemoteState{
-							X:      g.PlayerX,
-							Y:      g.PlayerY,
-							HP:     g.hp,
-							Attack: false,
-							Facing: g.facing,
-						})
-						lastSend = time.Now()
-					}
+			}
+			g.recorder.state(st)
+
+		case msg := <-msgChan:
+			switch m := msg.(type) {
+			case HealthUpdate:
+				// Damage is resolved by the server; flash whoever lost HP
+				if m.HP < g.hp {
+					g.hitFlash = time.Now()
+				}
+				if m.EnemyHP < g.enemyHP {
+					g.enemyHitFlash = time.Now()
+				}
+				g.hp = m.HP
+				g.enemyHP = m.EnemyHP
+				g.recordKnights()
+			case StateAck:
+				g.reconcile(m)
+			case RoomInfo:
+				g.roomCode = m.Code
+			case QueueInfo:
+				g.queued = true
+				g.rating = m.Rating
+			case RoundStart:
+				g.startRound(m)
+				g.recordKnights()
+			case MatchResult:
+				g.recorder.result(leftView(m, g.isLeft))
+				if !m.SeriesOver {
+					g.endRound(m)
+					continue
+				}
+				ticker.Stop()
+				g.showMatchResult(m, sendMsg, inputChan, msgChan)
+				if m.Forfeit {
+					// No one left to offer a rematch to
+					return
 				}
+				if !g.promptRematch(sendMsg, inputChan, netChan, msgChan) {
+					return
+				}
+				ticker.Reset(tickRate)
+				lastSend = time.Now()
+			case Disconnected:
+				g.showMessage((arenaLeft+arenaRight)/2, (arenaTop+arenaBottom)/2, "Lost connection to the server", tcell.StyleDefault.Foreground(tcell.ColorRed))
+				time.Sleep(2 * time.Second)
+				return
+			case Reconnecting:
+				g.reconnecting = true
+			case Reconnected:
+				g.reconnecting = false
+			case OpponentStatus:
+				g.enemyReconnecting = m.Reconnecting
+			case PlayerCount:
+				g.totalPlayers = m.Count
 			}
-
-		case result := <-matchResultChan:
-			ticker.Stop()
-			g.showMatchResult(result, sendMsg, inputChan)
-			return
 		}
 	}
 }
 
-func (g *Game) showMatchResult(result MatchResult, sendMsg func(interface{}), inputChan <-chan *tcell.EventKey) {
+func (g *Game) showMatchResult(result MatchResult, sendMsg func(interface{}), inputChan <-chan *tcell.EventKey, msgChan <-chan interface{}) {
 	g.screen.Clear()
 
 	centerX := (arenaLeft + arenaRight) / 2
 	centerY := (arenaTop + arenaBottom) / 2
 
-	// Format duration
-	seconds := float64(result.DurationMs) / 1000.0
+	// Format duration, of the whole series when there's more than a round
+	durationMs := result.DurationMs
+	if result.SeriesMs != 0 {
+		durationMs = result.SeriesMs
+	}
+	seconds := float64(durationMs) / 1000.0
 	timeStr := fmt.Sprintf("%.2fs", seconds)
 
+	// Series score, when there was more than one round
+	seriesStr := ""
+	if result.BestOf > 1 {
+		seriesStr = fmt.Sprintf(" - series %d-%d", result.Wins, result.EnemyWins)
+	}
+
+	// Rating change, for rated players
+	ratingMsg := ""
+	if result.RatingChange != 0 {
+		g.rating = result.Rating
+		ratingMsg = fmt.Sprintf("Rating: %d (%+d)", result.Rating, result.RatingChange)
+	}
+
+	if result.Forfeit {
+		msg := "Opponent disconnected"
+		for i, r := range msg {
+			g.screen.SetContent(centerX-len(msg)/2+i, centerY-4, r, nil, tcell.StyleDefault.Foreground(tcell.ColorRed))
+		}
+	}
+
 	if result.Won {
 		// Winner screen
 		msg := "YOU WIN!"
@@ -441,41 +543,58 @@ func (g *Game) showMatchResult(result MatchResult, sendMsg func(interface{}), in
 			g.screen.SetContent(centerX-len(msg)/2+i, centerY-2, r, nil, tcell.StyleDefault.Foreground(tcell.ColorGreen).Bold(true))
 		}
 
-		timeMsg := fmt.Sprintf("Time: %s", timeStr)
+		timeMsg := fmt.Sprintf("Time: %s%s", timeStr, seriesStr)
 		for i, r := range timeMsg {
 			g.screen.SetContent(centerX-len(timeMsg)/2+i, centerY, r, nil, tcell.StyleDefault)
 		}
+		for i, r := range ratingMsg {
+			g.screen.SetContent(centerX-len(ratingMsg)/2+i, centerY+1, r, nil, tcell.StyleDefault.Foreground(tcell.ColorDarkGray))
+		}
 
-		prompt := "Enter your name for the leaderboard:"
-		for i, r := range prompt {
-			g.screen.SetContent(centerX-len(prompt)/2+i, centerY+2, r, nil, tcell.StyleDefault)
+		// Without a token there's no leaderboard entry to claim, as in
+		// offline practice
+		if result.Token == "" {
+			g.screen.Show()
+			time.Sleep(3 * time.Second)
+			return
 		}
 
-		g.screen.Show()
+		// Registered players score under their own name; anyone else picks
+		// one, which the server then binds to their identity
+		name := g.playerName
+		if name == "" {
+			prompt := "Enter your name for the leaderboard:"
+			for i, r := range prompt {
+				g.screen.SetContent(centerX-len(prompt)/2+i, centerY+2, r, nil, tcell.StyleDefault)
+			}
+			g.screen.Show()
 
-		// Get player name input
-		name := g.getNameInput(centerX, centerY+4, inputChan)
+			name = g.getNameInput(centerX, centerY+4, inputChan)
+		}
+		// The name is only kept once the server has accepted it; one that
+		// belongs to someone else would lock us out of every later game
+		confirm, style := "Score not submitted", tcell.StyleDefault
 		if name != "" {
-			// Submit high score
 			sendMsg(HighScoreSubmit{
-				Type:       "highscore_submit",
 				PlayerName: name,
-				DurationMs: result.DurationMs,
+				Token:      result.Token,
 			})
+			if err := g.awaitHighScore(msgChan); err != nil {
+				confirm, style = "Score not submitted: "+err.Error(), tcell.StyleDefault.Foreground(tcell.ColorRed)
+			} else {
+				confirm, style = fmt.Sprintf("Score submitted: %s - %s", name, timeStr), tcell.StyleDefault.Foreground(tcell.ColorGreen)
+				if g.playerName == "" && g.identity != nil {
+					g.playerName = name
+					g.identity.Name = name
+					g.identity.save()
+				}
+			}
 		}
 
 		// Show confirmation
 		g.screen.Clear()
-		if name != "" {
-			confirm := fmt.Sprintf("Score submitted: %s - %s", name, timeStr)
-			for i, r := range confirm {
-				g.screen.SetContent(centerX-len(confirm)/2+i, centerY, r, nil, tcell.StyleDefault.Foreground(tcell.ColorGreen))
-			}
-		} else {
-			confirm := "Score not submitted"
-			for i, r := range confirm {
-				g.screen.SetContent(centerX-len(confirm)/2+i, centerY, r, nil, tcell.StyleDefault)
-			}
+		for i, r := range confirm {
+			g.screen.SetContent(centerX-len(confirm)/2+i, centerY, r, nil, style)
 		}
 		g.screen.Show()
 		time.Sleep(2 * time.Second)
@@ -486,16 +605,50 @@ func (g *Game) showMatchResult(result MatchResult, sendMsg func(interface{}), in
 			g.screen.SetContent(centerX-len(msg)/2+i, centerY-1, r, nil, tcell.StyleDefault.Foreground(tcell.ColorRed).Bold(true))
 		}
 
-		timeMsg := fmt.Sprintf("Match duration: %s", timeStr)
+		timeMsg := fmt.Sprintf("Match duration: %s%s", timeStr, seriesStr)
 		for i, r := range timeMsg {
 			g.screen.SetContent(centerX-len(timeMsg)/2+i, centerY+1, r, nil, tcell.StyleDefault)
 		}
+		for i, r := range ratingMsg {
+			g.screen.SetContent(centerX-len(ratingMsg)/2+i, centerY+2, r, nil, tcell.StyleDefault.Foreground(tcell.ColorDarkGray))
+		}
 
 		g.screen.Show()
 		time.Sleep(3 * time.Second)
 	}
 }
 
+// highScoreWait is how long the result screen waits for the server to
+// accept a high score.
+const highScoreWait = 5 * time.Second
+
+// awaitHighScore waits for the server's answer to a high score submission.
+// Anything else that arrives meanwhile is kept in g.deferred for the
+// rematch prompt.
+func (g *Game) awaitHighScore(msgChan <-chan interface{}) error {
+	timeout := time.After(highScoreWait)
+	for {
+		select {
+		case msg := <-msgChan:
+			switch m := msg.(type) {
+			case HighScoreAccepted:
+				return nil
+			case ErrorMessage:
+				return errors.New(m.Message)
+			case PlayerCount:
+				g.totalPlayers = m.Count
+			case Disconnected:
+				g.deferred = append(g.deferred, msg)
+				return errors.New("lost connection to the server")
+			default:
+				g.deferred = append(g.deferred, msg)
+			}
+		case <-timeout:
+			return errors.New("no reply from the server")
+		}
+	}
+}
+
 func (g *Game) getNameInput(x, y int, inputChan <-chan *tcell.EventKey) string {
 	name := ""
 	maxLen := 12
@@ -613,7 +766,7 @@ func (g *Game) draw() {
 		if time.Since(g.enemyHitFlash) < 200*time.Millisecond {
 			eStyle = eStyle.Foreground(tcell.ColorWhite)
 		}
-		g.drawCharacter(g.enemyX, g.enemyY, g.enemyFacing, eStyle)
+		g.drawCharacter(g.enemyDrawX, g.enemyDrawY, g.enemyFacing, eStyle)
 	}
 
 	// Sword slashes (drawn last so they appear on top)
@@ -628,7 +781,7 @@ func (g *Game) draw() {
 	// Enemy sword slash (matches enemy color)
 	if g.enemyConnected && time.Since(g.enemyAttack) < slashDuration {
 		enemySwordStyle := tcell.StyleDefault.Foreground(g.enemyColor)
-		g.drawSword(g.enemyX, g.enemyY, g.enemyFacing, enemySwordStyle)
+		g.drawSword(g.enemyDrawX, g.enemyDrawY, g.enemyFacing, enemySwordStyle)
 	}
 
 	// HP display (centered horizontally)
@@ -640,12 +793,22 @@ func (g *Game) draw() {
 	}
 	if g.enemyConnected {
 		enemyHP := fmt.Sprintf("Enemy: %d HP", g.enemyHP)
+		if g.enemyBot {
+			enemyHP = fmt.Sprintf("Enemy (bot): %d HP", g.enemyHP)
+		}
 		startX = centerX - len(enemyHP)/2
 		for i, r := range enemyHP {
 			g.screen.SetContent(startX+i, 1, r, nil, tcell.StyleDefault.Foreground(g.enemyColor))
 		}
 	} else {
 		msg := "Waiting for opponent..."
+		if g.roomCode != "" {
+			msg = fmt.Sprintf("Room code: %s - waiting for opponent...", g.roomCode)
+		} else if g.queued && g.playerName != "" {
+			msg = fmt.Sprintf("Finding an opponent near %d...", g.rating)
+		} else if g.queued {
+			msg = "Finding an opponent..."
+		}
 		startX = centerX - len(msg)/2
 		for i, r := range msg {
 			g.screen.SetContent(startX+i, 1, r, nil, tcell.StyleDefault)
@@ -661,26 +824,21 @@ func (g *Game) draw() {
 		}
 	}
 
-	// death
-	if g.hp <= 0 {
-		msg := "YOU DIED"
-		for i, r := range msg {
-			g.screen.SetContent(10+i, 5, r, nil, tcell.StyleDefault)
-		}
-		g.screen.Show()
-		time.Sleep(2 * time.Second)
-		g.screen.Fini()
-		os.Exit(0)
+	// Either side dropping holds the fight until they're back
+	banner := ""
+	if g.reconnecting {
+		banner = "Reconnecting..."
+	} else if g.enemyReconnecting {
+		banner = "Opponent reconnecting..."
 	}
-	if g.enemyHP <= 0 {
-		msg := "YOU WIN!"
-		for i, r := range msg {
-			g.screen.SetContent(10+i, 5, r, nil, tcell.StyleDefault)
-		}
-		g.screen.Show()
-		time.Sleep(2 * time.Second)
-		g.screen.Fini()
-		os.Exit(0)
+	for i, r := range banner {
+		g.screen.SetContent(centerX-len(banner)/2+i, (arenaTop+arenaBottom)/2-6, r, nil, tcell.StyleDefault.Foreground(tcell.ColorYellow).Bold(true))
+	}
+
+	g.drawScoreboard()
+
+	if g.showDebug {
+		g.drawDebug()
 	}
 
 	g.screen.Show()
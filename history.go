@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyKeep is how many recent matches the Upstash backend keeps in each
+// player's own list. Its list of every match isn't trimmed, and local
+// backends keep everything.
+const historyKeep = 100
+
+// MatchRecord is one finished round. Anonymous players have an empty name.
+type MatchRecord struct {
+	LobbyID    int       `json:"lobby_id"`
+	Round      int       `json:"round"`
+	BestOf     int       `json:"best_of"`
+	Winner     string    `json:"winner"`
+	Loser      string    `json:"loser"`
+	WinnerHits int       `json:"winner_hits"`
+	LoserHits  int       `json:"loser_hits"`
+	DurationMs int64     `json:"duration_ms"`
+	StartedAt  time.Time `json:"started_at"`
+	EndedAt    time.Time `json:"ended_at"`
+	Bot        bool      `json:"bot,omitempty"`     // one side was a server bot
+	Forfeit    bool      `json:"forfeit,omitempty"` // the loser disconnected
+}
+
+// PlayerHistory is a player's win/loss record and their most recent
+// matches, newest first.
+type PlayerHistory struct {
+	Name    string        `json:"name"`
+	Wins    int           `json:"wins"`
+	Losses  int           `json:"losses"`
+	Matches []MatchRecord `json:"matches"`
+}
+
+// HistoryStore persists finished matches. Names are matched
+// case-insensitively, like registered identities.
+type HistoryStore interface {
+	Record(m MatchRecord) error
+	History(name string, limit int) (PlayerHistory, error)
+}
+
+// newHistoryStore picks a backend by name; see storageKind for the default.
+func newHistoryStore(kind, path string) (HistoryStore, error) {
+	switch storageKind(kind) {
+	case "memory":
+		return &memoryHistory{}, nil
+	case "file":
+		store, err := openFileHistory(path)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("Using match history file", path)
+		return store, nil
+	case "upstash":
+		client, err := newUpstashClient()
+		if err != nil {
+			return nil, err
+		}
+		return &upstashHistory{client}, nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", kind)
+}
+
+// MEMORY
+
+// memoryHistory keeps every match, indexed by each named player so their
+// history can be looked up. Anonymous players have no index.
+type memoryHistory struct {
+	mu      sync.Mutex
+	matches []MatchRecord    // every match, oldest first
+	byName  map[string][]int // lowercased name -> indexes into matches
+}
+
+func (m *memoryHistory) Record(match MatchRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(match)
+	return nil
+}
+
+// add keeps a match and indexes it under both players. Caller must hold
+// m.mu.
+func (m *memoryHistory) add(match MatchRecord) {
+	if m.byName == nil {
+		m.byName = make(map[string][]int)
+	}
+	m.matches = append(m.matches, match)
+	for _, name := range []string{match.Winner, match.Loser} {
+		if name != "" {
+			key := strings.ToLower(name)
+			m.byName[key] = append(m.byName[key], len(m.matches)-1)
+		}
+	}
+}
+
+func (m *memoryHistory) History(name string, limit int) (PlayerHistory, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := PlayerHistory{Name: name, Matches: []MatchRecord{}}
+	if name == "" {
+		return h, nil
+	}
+	idx := m.byName[strings.ToLower(name)]
+	for i := len(idx) - 1; i >= 0; i-- {
+		match := m.matches[idx[i]]
+		if strings.EqualFold(match.Winner, name) {
+			h.Wins++
+		} else {
+			h.Losses++
+		}
+		if len(h.Matches) < limit {
+			h.Matches = append(h.Matches, match)
+		}
+	}
+	return h, nil
+}
+
+// FILE
+
+// fileHistory is a memoryHistory that appends each match to a JSON lines
+// file, so recording stays cheap however long the history gets.
+type fileHistory struct {
+	memoryHistory
+	path string
+}
+
+func openFileHistory(path string) (*fileHistory, error) {
+	f := &fileHistory{path: path}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var match MatchRecord
+		if err := json.Unmarshal(scanner.Bytes(), &match); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		f.add(match)
+	}
+	return f, scanner.Err()
+}
+
+func (f *fileHistory) Record(match MatchRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.add(match)
+
+	line, err := json.Marshal(match)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// UPSTASH
+
+// upstashHistory keeps every match in one Redis list, and for each named
+// player their last historyKeep matches in a list and their all-time record
+// in a hash.
+type upstashHistory struct {
+	upstashClient
+}
+
+func (u *upstashHistory) Record(match MatchRecord) error {
+	data, err := json.Marshal(match)
+	if err != nil {
+		return err
+	}
+	if _, err := u.request([]interface{}{"RPUSH", "matches", string(data)}); err != nil {
+		return err
+	}
+	for _, side := range []struct{ name, field string }{{match.Winner, "wins"}, {match.Loser, "losses"}} {
+		if side.name == "" {
+			continue
+		}
+		key := strings.ToLower(side.name)
+		if _, err := u.request([]interface{}{"LPUSH", "history:" + key, string(data)}); err != nil {
+			return err
+		}
+		if _, err := u.request([]interface{}{"LTRIM", "history:" + key, 0, historyKeep - 1}); err != nil {
+			return err
+		}
+		if _, err := u.request([]interface{}{"HINCRBY", "record:" + key, side.field, 1}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *upstashHistory) History(name string, limit int) (PlayerHistory, error) {
+	h := PlayerHistory{Name: name, Matches: []MatchRecord{}}
+	if name == "" {
+		return h, nil
+	}
+	key := strings.ToLower(name)
+
+	result, err := u.request([]interface{}{"HMGET", "record:" + key, "wins", "losses"})
+	if err != nil {
+		return h, err
+	}
+	if arr, ok := result.([]interface{}); ok && len(arr) == 2 {
+		// Missing fields come back nil and stay at zero
+		s, _ := arr[0].(string)
+		h.Wins, _ = strconv.Atoi(s)
+		s, _ = arr[1].(string)
+		h.Losses, _ = strconv.Atoi(s)
+	}
+
+	result, err = u.request([]interface{}{"LRANGE", "history:" + key, 0, limit - 1})
+	if err != nil {
+		return h, err
+	}
+	arr, _ := result.([]interface{})
+	for _, item := range arr {
+		var match MatchRecord
+		if s, ok := item.(string); ok && json.Unmarshal([]byte(s), &match) == nil {
+			h.Matches = append(h.Matches, match)
+		}
+	}
+	return h, nil
+}
+
+// SERVER
+
+// saveMatch records a finished round off the lobby lock, since stores may
+// be remote.
+func saveMatch(match MatchRecord) {
+	if err := history.Record(match); err != nil {
+		fmt.Println("Failed to save match:", err)
+	}
+}
+
+// serveHistory answers /history?name=NAME[&limit=N].
+func serveHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	name := r.URL.Query().Get("name")
+	if !validPlayerName(name) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "a valid player name is required"})
+		return
+	}
+	limit := 20
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = min(n, historyKeep)
+	}
+
+	h, err := history.History(name, limit)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(h)
+}
+
+// CLIENT
+
+// showHistory prints a player's record and recent matches.
+func showHistory(server, name string) {
+	resp, err := http.Get(httpBase(server) + "history?name=" + url.QueryEscape(name))
+	if err != nil {
+		fmt.Println("Error fetching match history:", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var h struct {
+		PlayerHistory
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+		fmt.Println("Error parsing match history:", err)
+		return
+	}
+	if h.Error != "" {
+		fmt.Println("Error fetching match history:", h.Error)
+		return
+	}
+
+	fmt.Printf("\n=== %s: %dW - %dL ===\n\n", name, h.Wins, h.Losses)
+	if len(h.Matches) == 0 {
+		fmt.Println("No matches yet.")
+		return
+	}
+
+	fmt.Printf(" %-17s %-6s %-13s %-8s %-6s %s\n", "When", "Result", "Opponent", "Time", "Hits", "Round")
+	fmt.Println(strings.Repeat("─", 62))
+	for _, m := range h.Matches {
+		result, opponent, hits := "WIN", m.Loser, fmt.Sprintf("%d-%d", m.WinnerHits, m.LoserHits)
+		if !strings.EqualFold(m.Winner, name) {
+			result, opponent, hits = "LOSS", m.Winner, fmt.Sprintf("%d-%d", m.LoserHits, m.WinnerHits)
+		}
+		if opponent == "" && m.Bot {
+			opponent = "bot"
+		} else if opponent == "" {
+			opponent = "anonymous"
+		}
+		round := ""
+		if m.BestOf > 1 {
+			round = fmt.Sprintf("%d of %d", m.Round, m.BestOf)
+		}
+		if m.Forfeit {
+			round = strings.TrimSpace(round + " forfeit")
+		}
+		seconds := float64(m.DurationMs) / 1000.0
+		line := fmt.Sprintf(" %-17s %-6s %-13s %-8s %-6s %s",
+			m.EndedAt.Local().Format("2006-01-02 15:04"), result, opponent, fmt.Sprintf("%.2fs", seconds), hits, round)
+		fmt.Println(strings.TrimRight(line, " "))
+	}
+	fmt.Println()
+}
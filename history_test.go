@@ -0,0 +1,89 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// historyMatches are recorded oldest first by the history tests.
+var historyMatches = []MatchRecord{
+	{LobbyID: 1, Winner: "alice", Loser: "bob"},
+	{LobbyID: 2, Winner: "", Loser: ""},
+	{LobbyID: 3, Winner: "Bob", Loser: ""},
+	{LobbyID: 4, Winner: "", Loser: "ALICE"},
+	{LobbyID: 5, Winner: "alice", Loser: "carol"},
+}
+
+func checkHistory(t *testing.T, store HistoryStore) {
+	t.Helper()
+	tests := []struct {
+		name        string
+		limit       int
+		wins        int
+		losses      int
+		wantLobbies []int // newest first
+	}{
+		{"alice", 10, 2, 1, []int{5, 4, 1}},
+		{"ALICE", 2, 2, 1, []int{5, 4}},
+		{"bob", 10, 1, 1, []int{3, 1}},
+		{"carol", 10, 0, 1, []int{5}},
+		{"dave", 10, 0, 0, nil},
+		{"", 10, 0, 0, nil},
+	}
+	for _, tt := range tests {
+		h, err := store.History(tt.name, tt.limit)
+		if err != nil {
+			t.Fatalf("History(%q): %v", tt.name, err)
+		}
+		if h.Wins != tt.wins || h.Losses != tt.losses {
+			t.Errorf("History(%q) record = %d-%d, want %d-%d", tt.name, h.Wins, h.Losses, tt.wins, tt.losses)
+		}
+		var lobbies []int
+		for _, m := range h.Matches {
+			lobbies = append(lobbies, m.LobbyID)
+		}
+		if len(lobbies) != len(tt.wantLobbies) {
+			t.Errorf("History(%q, %d) matches = %v, want %v", tt.name, tt.limit, lobbies, tt.wantLobbies)
+			continue
+		}
+		for i := range lobbies {
+			if lobbies[i] != tt.wantLobbies[i] {
+				t.Errorf("History(%q, %d) matches = %v, want %v", tt.name, tt.limit, lobbies, tt.wantLobbies)
+				break
+			}
+		}
+	}
+}
+
+func TestMemoryHistory(t *testing.T) {
+	store := &memoryHistory{}
+	for _, m := range historyMatches {
+		store.Record(m)
+	}
+	if len(store.matches) != len(historyMatches) {
+		t.Errorf("kept %d matches, want all %d", len(store.matches), len(historyMatches))
+	}
+	checkHistory(t, store)
+}
+
+func TestFileHistoryRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	store, err := openFileHistory(path)
+	if err != nil {
+		t.Fatalf("opening new history: %v", err)
+	}
+	for _, m := range historyMatches {
+		if err := store.Record(m); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+
+	reopened, err := openFileHistory(path)
+	if err != nil {
+		t.Fatalf("reopening history: %v", err)
+	}
+	if len(reopened.matches) != len(historyMatches) {
+		t.Errorf("reloaded %d matches, want all %d", len(reopened.matches), len(historyMatches))
+	}
+	checkHistory(t, reopened)
+}
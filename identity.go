@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// errNameTaken is returned when a name is already bound to another
+// player's identity.
+var errNameTaken = errors.New("name is registered to another player")
+
+// IdentityStore binds player names to identity tokens so nobody else can
+// post scores or play rated matches under a name once it's claimed.
+type IdentityStore interface {
+	// Claim binds name to token if it's free, and otherwise checks that
+	// token owns it. Names are compared case-insensitively.
+	Claim(name, token string) error
+}
+
+// newIdentityStore picks a backend by name; see storageKind for the
+// default.
+func newIdentityStore(kind, path string) (IdentityStore, error) {
+	switch storageKind(kind) {
+	case "memory":
+		return &memoryIdentities{}, nil
+	case "file":
+		store, err := openFileIdentities(path)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("Using identities file", path)
+		return store, nil
+	case "upstash":
+		client, err := newUpstashClient()
+		if err != nil {
+			return nil, err
+		}
+		return &upstashIdentities{client}, nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", kind)
+}
+
+// hashToken is what the server stores in place of a client's token, so a
+// leaked identities file can't be used to impersonate anyone.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sameOwner compares a stored token hash against a presented token.
+func sameOwner(hash, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(hashToken(token))) == 1
+}
+
+// MEMORY
+
+type memoryIdentities struct {
+	mu     sync.Mutex
+	owners map[string]string // lowercased name -> token hash
+}
+
+func (m *memoryIdentities) Claim(name, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.claim(name, token)
+	return err
+}
+
+// claim binds name to token if it's free, reporting whether it was newly
+// bound. Caller must hold m.mu.
+func (m *memoryIdentities) claim(name, token string) (bool, error) {
+	key := strings.ToLower(name)
+	if hash, ok := m.owners[key]; ok {
+		if !sameOwner(hash, token) {
+			return false, errNameTaken
+		}
+		return false, nil
+	}
+	if m.owners == nil {
+		m.owners = make(map[string]string)
+	}
+	m.owners[key] = hashToken(token)
+	return true, nil
+}
+
+// FILE
+
+// fileIdentities is a memoryIdentities that rewrites a JSON file whenever a
+// new name is claimed.
+type fileIdentities struct {
+	memoryIdentities
+	path string
+}
+
+func openFileIdentities(path string) (*fileIdentities, error) {
+	f := &fileIdentities{path: path}
+	if err := readJSONFile(path, &f.owners); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *fileIdentities) Claim(name, token string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	added, err := f.claim(name, token)
+	if err != nil || !added {
+		return err
+	}
+	return writeJSONFile(f.path, f.owners)
+}
+
+// UPSTASH
+
+// upstashIdentities keeps token hashes in a Redis hash keyed by lowercased
+// name. HSETNX makes the first claim win when two players race for a name.
+type upstashIdentities struct {
+	upstashClient
+}
+
+func (u *upstashIdentities) Claim(name, token string) error {
+	key := strings.ToLower(name)
+	if _, err := u.request([]interface{}{"HSETNX", "identities", key, hashToken(token)}); err != nil {
+		return err
+	}
+	result, err := u.request([]interface{}{"HGET", "identities", key})
+	if err != nil {
+		return err
+	}
+	if hash, _ := result.(string); !sameOwner(hash, token) {
+		return errNameTaken
+	}
+	return nil
+}
+
+// CLIENT
+
+// Identity is this machine's player identity: the name it plays under and
+// the secret its per-server tokens are derived from. It's created on first
+// run and kept in the user config dir.
+type Identity struct {
+	Name  string `json:"name,omitempty"`
+	Token string `json:"token"`
+
+	path string
+}
+
+// identityPath is where the identity lives. DUEL_CONFIG_DIR overrides the
+// config dir, which is handy for running two clients on one machine.
+func identityPath() (string, error) {
+	dir := os.Getenv("DUEL_CONFIG_DIR")
+	if dir == "" {
+		base, err := os.UserConfigDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(base, "cli-duel")
+	}
+	return filepath.Join(dir, "identity.json"), nil
+}
+
+// loadIdentity reads the local identity, creating one with a fresh token
+// if there isn't one yet.
+func loadIdentity() (*Identity, error) {
+	path, err := identityPath()
+	if err != nil {
+		return nil, err
+	}
+	id := &Identity{path: path}
+	if err := readJSONFile(path, id); err != nil {
+		return nil, err
+	}
+	if id.Token == "" {
+		b := make([]byte, 32)
+		rand.Read(b)
+		id.Token = hex.EncodeToString(b)
+		if err := id.save(); err != nil {
+			return nil, err
+		}
+	}
+	return id, nil
+}
+
+// serverToken is the token that proves this identity to server. Each host
+// gets its own, so a server we join can't replay ours to another one, and
+// the stored secret itself is never sent.
+func (id *Identity) serverToken(server string) string {
+	host := server
+	if u, err := url.Parse(server); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	mac := hmac.New(sha256.New, []byte(id.Token))
+	mac.Write([]byte(strings.ToLower(host)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// save writes the identity back to disk, readable only by this user.
+func (id *Identity) save() error {
+	if err := os.MkdirAll(filepath.Dir(id.path), 0o700); err != nil {
+		return err
+	}
+	return writeJSONFile(id.path, id)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// claimAttempt is one Claim call and what it should return.
+type claimAttempt struct {
+	name, token string
+	wantAdded   bool
+	wantErr     error
+}
+
+func TestMemoryIdentitiesClaim(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts []claimAttempt
+	}{
+		{"free name", []claimAttempt{
+			{"alice", "tok-a", true, nil},
+		}},
+		{"owner reclaims", []claimAttempt{
+			{"alice", "tok-a", true, nil},
+			{"alice", "tok-a", false, nil},
+		}},
+		{"taken by another token", []claimAttempt{
+			{"alice", "tok-a", true, nil},
+			{"alice", "tok-b", false, errNameTaken},
+		}},
+		{"case-insensitive", []claimAttempt{
+			{"Alice", "tok-a", true, nil},
+			{"ALICE", "tok-b", false, errNameTaken},
+			{"alice", "tok-a", false, nil},
+		}},
+		{"one token, many names", []claimAttempt{
+			{"alice", "tok-a", true, nil},
+			{"alice2", "tok-a", true, nil},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &memoryIdentities{}
+			for _, a := range tt.attempts {
+				added, err := m.claim(a.name, a.token)
+				if added != a.wantAdded || !errors.Is(err, a.wantErr) {
+					t.Errorf("claim(%q, %q) = %v, %v; want %v, %v", a.name, a.token, added, err, a.wantAdded, a.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryIdentitiesStoreHashes(t *testing.T) {
+	m := &memoryIdentities{}
+	m.claim("alice", "secret-token")
+	for _, hash := range m.owners {
+		if strings.Contains(hash, "secret-token") {
+			t.Errorf("stored %q, which holds the raw token", hash)
+		}
+	}
+}
+
+func TestFileIdentitiesRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identities.json")
+	store, err := openFileIdentities(path)
+	if err != nil {
+		t.Fatalf("opening new identities: %v", err)
+	}
+	if err := store.Claim("alice", "tok-a"); err != nil {
+		t.Fatalf("Claim: %v", err)
+	}
+
+	reopened, err := openFileIdentities(path)
+	if err != nil {
+		t.Fatalf("reopening identities: %v", err)
+	}
+	if err := reopened.Claim("ALICE", "tok-b"); !errors.Is(err, errNameTaken) {
+		t.Errorf("claiming a saved name with another token = %v, want %v", err, errNameTaken)
+	}
+	if err := reopened.Claim("alice", "tok-a"); err != nil {
+		t.Errorf("owner reclaiming a saved name: %v", err)
+	}
+}
+
+func TestServerToken(t *testing.T) {
+	id := &Identity{Token: "local-secret"}
+	home := id.serverToken("wss://duel.example.com/ws")
+	tests := []struct {
+		name   string
+		server string
+		same   bool // as home's token
+	}{
+		{"same server", "wss://duel.example.com/ws", true},
+		{"other path and query", "wss://duel.example.com/ws?room=ABCDE&name=alice", true},
+		{"host case", "wss://DUEL.example.com/ws", true},
+		{"LAN host", "ws://192.168.1.20:8080/ws", false},
+		{"other port", "wss://duel.example.com:8443/ws", false},
+		{"other host", "wss://evil.example.com/ws", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := id.serverToken(tt.server)
+			if (got == home) != tt.same {
+				t.Errorf("serverToken(%q) == home token: %v, want %v", tt.server, got == home, tt.same)
+			}
+			if strings.Contains(got, id.Token) {
+				t.Errorf("serverToken(%q) = %q, which holds the secret", tt.server, got)
+			}
+		})
+	}
+	other := &Identity{Token: "another-secret"}
+	if other.serverToken("wss://duel.example.com/ws") == home {
+		t.Error("two identities got the same token for one server")
+	}
+}
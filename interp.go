@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Entity interpolation tuning. The enemy is drawn interpDelay in the past so
+// there are usually two snapshots to blend between; if none arrive for a
+// while we extrapolate along its last velocity for at most maxExtrapolation
+// before holding still.
+const (
+	interpDelay        = 100 * time.Millisecond
+	maxExtrapolation   = 60 * time.Millisecond
+	snapshotBufferSize = 32
+)
+
+// remoteSnapshot is an enemy position stamped with when we received it.
+type remoteSnapshot struct {
+	at   time.Time
+	x, y int
+}
+
+// snapshotBuffer holds recent enemy snapshots, oldest first.
+type snapshotBuffer struct {
+	snaps []remoteSnapshot
+}
+
+func (b *snapshotBuffer) push(at time.Time, x, y int) {
+	b.snaps = append(b.snaps, remoteSnapshot{at: at, x: x, y: y})
+	if len(b.snaps) > snapshotBufferSize {
+		b.snaps = b.snaps[len(b.snaps)-snapshotBufferSize:]
+	}
+}
+
+// depth returns how many snapshots are newer than the render time t, i.e.
+// how much headroom interpolation has before it must extrapolate.
+func (b *snapshotBuffer) depth(t time.Time) int {
+	n := 0
+	for i := len(b.snaps) - 1; i >= 0 && b.snaps[i].at.After(t); i-- {
+		n++
+	}
+	return n
+}
+
+// sample returns the enemy position at time t and whether it had to be
+// extrapolated past the newest snapshot.
+func (b *snapshotBuffer) sample(t time.Time) (x, y int, extrapolated bool) {
+	n := len(b.snaps)
+	if n == 0 {
+		return 0, 0, false
+	}
+	if n == 1 || !t.After(b.snaps[0].at) {
+		return b.snaps[0].x, b.snaps[0].y, false
+	}
+
+	// Drop snapshots we'll never render again, keeping one before t
+	for len(b.snaps) > 2 && !b.snaps[1].at.After(t) {
+		b.snaps = b.snaps[1:]
+	}
+	n = len(b.snaps)
+
+	from, to := b.snaps[n-2], b.snaps[n-1]
+	for i := 1; i < n; i++ {
+		if b.snaps[i].at.After(t) {
+			from, to = b.snaps[i-1], b.snaps[i]
+			break
+		}
+	}
+
+	span := to.at.Sub(from.at)
+	if span <= 0 {
+		return to.x, to.y, false
+	}
+	if t.After(to.at) {
+		extrapolated = true
+		t = to.at.Add(min(t.Sub(to.at), maxExtrapolation))
+	}
+	frac := float64(t.Sub(from.at)) / float64(span)
+	x = from.x + int(math.Round(frac*float64(to.x-from.x)))
+	y = from.y + int(math.Round(frac*float64(to.y-from.y)))
+	x, y = clampToArena(x, y)
+	return x, y, extrapolated
+}
+
+// updateEnemyRender moves the drawn enemy to its interpolated position.
+func (g *Game) updateEnemyRender(now time.Time) {
+	if len(g.enemyBuf.snaps) == 0 {
+		g.enemyDrawX, g.enemyDrawY = g.enemyX, g.enemyY
+		return
+	}
+	t := now.Add(-interpDelay)
+	g.enemyDrawX, g.enemyDrawY, g.enemyExtrapolating = g.enemyBuf.sample(t)
+	g.enemyBufDepth = g.enemyBuf.depth(t)
+}
+
+// drawDebug shows netcode stats in the bottom left corner. Toggled with F3.
+func (g *Game) drawDebug() {
+	_, h := g.screen.Size()
+	mode := "interp"
+	if g.enemyExtrapolating {
+		mode = "extrap"
+	}
+	info := fmt.Sprintf("buf:%d delay:%dms %s pending:%d", g.enemyBufDepth, interpDelay.Milliseconds(), mode, len(g.pending))
+	for i, r := range info {
+		g.screen.SetContent(i, h-1, r, nil, tcell.StyleDefault.Foreground(tcell.ColorDarkGray))
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotBufferSample(t *testing.T) {
+	t0 := time.Now()
+	ms := func(n int) time.Time { return t0.Add(time.Duration(n) * time.Millisecond) }
+	moving := []remoteSnapshot{{ms(0), 20, 10}, {ms(30), 23, 10}, {ms(60), 26, 13}}
+
+	tests := []struct {
+		name             string
+		snaps            []remoteSnapshot
+		at               time.Time
+		wantX, wantY     int
+		wantExtrapolated bool
+	}{
+		{"empty", nil, ms(0), 0, 0, false},
+		{"single snapshot", []remoteSnapshot{{ms(0), 40, 8}}, ms(500), 40, 8, false},
+		{"before oldest", moving, ms(-50), 20, 10, false},
+		{"between first two", moving, ms(10), 21, 10, false},
+		{"on a snapshot", moving, ms(30), 23, 10, false},
+		{"between last two", moving, ms(40), 24, 11, false},
+		{"on newest", moving, ms(60), 26, 13, false},
+		{"just past newest", moving, ms(80), 28, 15, true},
+		{"extrapolation capped", moving, ms(1000), 32, 19, true},
+		{"extrapolation clamped to arena", []remoteSnapshot{{ms(0), 70, 10}, {ms(30), 76, 10}}, ms(90), arenaRight - 2, 10, true},
+		{"same timestamp", []remoteSnapshot{{ms(0), 20, 10}, {ms(0), 30, 10}}, ms(10), 30, 10, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &snapshotBuffer{snaps: append([]remoteSnapshot(nil), tt.snaps...)}
+			x, y, extrapolated := b.sample(tt.at)
+			if x != tt.wantX || y != tt.wantY || extrapolated != tt.wantExtrapolated {
+				t.Errorf("sample = (%d, %d, %v), want (%d, %d, %v)", x, y, extrapolated, tt.wantX, tt.wantY, tt.wantExtrapolated)
+			}
+		})
+	}
+}
+
+func TestSnapshotBufferSampleForwardOnly(t *testing.T) {
+	t0 := time.Now()
+	b := &snapshotBuffer{}
+	for i := 0; i < 10; i++ {
+		b.push(t0.Add(time.Duration(i)*tickRate), 10+i, 10)
+	}
+	// Rendering walks forward in time, dropping snapshots it's done with
+	for i := 0; i < 9; i++ {
+		x, _, _ := b.sample(t0.Add(time.Duration(i) * tickRate))
+		if x != 10+i {
+			t.Fatalf("sample at tick %d: x = %d, want %d", i, x, 10+i)
+		}
+	}
+	if len(b.snaps) > 2 {
+		t.Errorf("%d snapshots kept, want at most 2", len(b.snaps))
+	}
+}
+
+func TestSnapshotBufferPushCapped(t *testing.T) {
+	t0 := time.Now()
+	b := &snapshotBuffer{}
+	for i := 0; i < snapshotBufferSize+5; i++ {
+		b.push(t0.Add(time.Duration(i)*tickRate), i, 0)
+	}
+	if len(b.snaps) != snapshotBufferSize {
+		t.Fatalf("%d snapshots kept, want %d", len(b.snaps), snapshotBufferSize)
+	}
+	if b.snaps[0].x != 5 {
+		t.Errorf("oldest kept x = %d, want 5", b.snaps[0].x)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LeaderboardStore persists the fastest takedowns. Lower durations rank
+// higher.
+type LeaderboardStore interface {
+	Submit(playerName string, durationMs int64) error
+	Top(limit int) ([]HighScore, error)
+}
+
+// newLeaderboardStore picks a backend by name; see storageKind for the
+// default.
+func newLeaderboardStore(kind, path string) (LeaderboardStore, error) {
+	switch storageKind(kind) {
+	case "memory":
+		fmt.Println("Using in-memory leaderboard")
+		return &memoryLeaderboard{}, nil
+	case "file":
+		store, err := openFileLeaderboard(path)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("Using leaderboard file", path)
+		return store, nil
+	case "upstash":
+		client, err := newUpstashClient()
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("Connected to Upstash Redis")
+		return &upstashLeaderboard{client}, nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", kind)
+}
+
+// MEMORY
+
+// memoryLeaderboard keeps every score sorted by duration. Scores are lost
+// when the server stops.
+type memoryLeaderboard struct {
+	mu     sync.Mutex
+	scores []HighScore
+}
+
+func (m *memoryLeaderboard) Submit(playerName string, durationMs int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.insert(HighScore{PlayerName: playerName, DurationMs: durationMs})
+	return nil
+}
+
+// insert adds a score after any existing scores with the same duration, so
+// earlier takedowns keep their rank. Caller must hold m.mu.
+func (m *memoryLeaderboard) insert(score HighScore) {
+	i := sort.Search(len(m.scores), func(i int) bool {
+		return m.scores[i].DurationMs > score.DurationMs
+	})
+	m.scores = append(m.scores, HighScore{})
+	copy(m.scores[i+1:], m.scores[i:])
+	m.scores[i] = score
+}
+
+func (m *memoryLeaderboard) Top(limit int) ([]HighScore, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := min(limit, len(m.scores))
+	scores := make([]HighScore, n)
+	for i := range scores {
+		scores[i] = m.scores[i]
+		scores[i].Rank = i + 1
+	}
+	return scores, nil
+}
+
+// FILE
+
+// fileLeaderboard is a memoryLeaderboard that rewrites a JSON file after
+// every submission, for `duel host` without Redis.
+type fileLeaderboard struct {
+	memoryLeaderboard
+	path string
+}
+
+func openFileLeaderboard(path string) (*fileLeaderboard, error) {
+	f := &fileLeaderboard{path: path}
+	var scores []HighScore
+	if err := readJSONFile(path, &scores); err != nil {
+		return nil, err
+	}
+	for _, score := range scores {
+		f.insert(score)
+	}
+	return f, nil
+}
+
+func (f *fileLeaderboard) Submit(playerName string, durationMs int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.insert(HighScore{PlayerName: playerName, DurationMs: durationMs})
+	return f.save()
+}
+
+// save rewrites the leaderboard file. Caller must hold f.mu.
+func (f *fileLeaderboard) save() error {
+	return writeJSONFile(f.path, f.scores)
+}
+
+// UPSTASH
+
+// upstashLeaderboard stores scores in a Redis sorted set through the
+// Upstash REST API.
+type upstashLeaderboard struct {
+	upstashClient
+}
+
+func (u *upstashLeaderboard) Submit(playerName string, durationMs int64) error {
+	// Use sorted set with duration as score (lower is better)
+	// Member format: "playerName:timestamp" for uniqueness
+	member := fmt.Sprintf("%s:%d", playerName, time.Now().UnixNano())
+	_, err := u.request([]interface{}{"ZADD", "highscores", durationMs, member})
+	return err
+}
+
+func (u *upstashLeaderboard) Top(limit int) ([]HighScore, error) {
+	result, err := u.request([]interface{}{"ZRANGE", "highscores", "0", strconv.Itoa(limit - 1), "WITHSCORES"})
+	if err != nil {
+		return nil, err
+	}
+
+	// Result is an array of [member, score, member, score, ...]
+	arr, ok := result.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected response format")
+	}
+
+	scores := make([]HighScore, 0)
+	for i := 0; i < len(arr); i += 2 {
+		member := arr[i].(string)
+		scoreStr := arr[i+1].(string)
+		score, _ := strconv.ParseInt(scoreStr, 10, 64)
+
+		// Parse "playerName:timestamp" format
+		parts := strings.Split(member, ":")
+		playerName := parts[0]
+		if len(parts) > 2 {
+			// Handle names with colons by rejoining all but last part
+			playerName = strings.Join(parts[:len(parts)-1], ":")
+		}
+		scores = append(scores, HighScore{
+			Rank:       len(scores) + 1,
+			PlayerName: playerName,
+			DurationMs: score,
+		})
+	}
+	return scores, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// score is a submission in leaderboard tests.
+type score struct {
+	name string
+	ms   int64
+}
+
+func submitAll(t *testing.T, store LeaderboardStore, scores []score) {
+	t.Helper()
+	for _, s := range scores {
+		if err := store.Submit(s.name, s.ms); err != nil {
+			t.Fatalf("Submit(%q, %d): %v", s.name, s.ms, err)
+		}
+	}
+}
+
+func TestMemoryLeaderboardTop(t *testing.T) {
+	tests := []struct {
+		name   string
+		submit []score
+		limit  int
+		want   []HighScore
+	}{
+		{
+			name:  "empty",
+			limit: 10,
+			want:  []HighScore{},
+		},
+		{
+			name:   "fastest first",
+			submit: []score{{"slow", 9000}, {"fast", 1200}, {"mid", 4000}},
+			limit:  10,
+			want: []HighScore{
+				{Rank: 1, PlayerName: "fast", DurationMs: 1200},
+				{Rank: 2, PlayerName: "mid", DurationMs: 4000},
+				{Rank: 3, PlayerName: "slow", DurationMs: 9000},
+			},
+		},
+		{
+			name:   "ties keep submission order",
+			submit: []score{{"first", 3000}, {"quick", 1000}, {"second", 3000}, {"third", 3000}},
+			limit:  10,
+			want: []HighScore{
+				{Rank: 1, PlayerName: "quick", DurationMs: 1000},
+				{Rank: 2, PlayerName: "first", DurationMs: 3000},
+				{Rank: 3, PlayerName: "second", DurationMs: 3000},
+				{Rank: 4, PlayerName: "third", DurationMs: 3000},
+			},
+		},
+		{
+			name:   "truncated to limit",
+			submit: []score{{"d", 4000}, {"a", 1000}, {"c", 3000}, {"b", 2000}},
+			limit:  2,
+			want: []HighScore{
+				{Rank: 1, PlayerName: "a", DurationMs: 1000},
+				{Rank: 2, PlayerName: "b", DurationMs: 2000},
+			},
+		},
+		{
+			name:   "zero limit",
+			submit: []score{{"a", 1000}},
+			limit:  0,
+			want:   []HighScore{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &memoryLeaderboard{}
+			submitAll(t, store, tt.submit)
+			got, err := store.Top(tt.limit)
+			if err != nil {
+				t.Fatalf("Top(%d): %v", tt.limit, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Top(%d) = %+v, want %+v", tt.limit, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileLeaderboardRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leaderboard.json")
+	store, err := openFileLeaderboard(path)
+	if err != nil {
+		t.Fatalf("opening new leaderboard: %v", err)
+	}
+	submitAll(t, store, []score{{"b", 2000}, {"a", 1000}, {"c", 2000}})
+	want, err := store.Top(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openFileLeaderboard(path)
+	if err != nil {
+		t.Fatalf("reopening leaderboard: %v", err)
+	}
+	got, err := reopened.Top(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("reopened Top = %+v, want %+v", got, want)
+	}
+
+	// Ties stay behind scores loaded from the file
+	submitAll(t, reopened, []score{{"d", 2000}})
+	got, _ = reopened.Top(10)
+	if last := got[len(got)-1]; last.PlayerName != "d" || last.Rank != 4 {
+		t.Errorf("new tie ranked %+v, want d at rank 4", last)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// LobbyInfo summarises a public lobby for the lobby browser.
+type LobbyInfo struct {
+	ID         int    `json:"id"`
+	Players    int    `json:"players"`
+	Spectators int    `json:"spectators"`
+	InProgress bool   `json:"in_progress"`
+	ElapsedMs  int64  `json:"elapsed_ms"` // fight time if in progress, otherwise time spent waiting
+	HP         [2]int `json:"hp"`
+	Round      int    `json:"round"`
+	BestOf     int    `json:"best_of"`
+	Bot        bool   `json:"bot,omitempty"` // one seat is a server bot
+}
+
+// SERVER
+
+// listLobbies describes every public lobby. Private rooms are left out so
+// their codes stay the only way in.
+func listLobbies() []LobbyInfo {
+	lobbyMu.Lock()
+	defer lobbyMu.Unlock()
+
+	infos := make([]LobbyInfo, 0, len(lobbies))
+	for _, l := range lobbies {
+		if l.Code != "" {
+			continue
+		}
+		l.mu.Lock()
+		info := LobbyInfo{
+			ID:         l.ID,
+			Spectators: len(l.Spectators),
+			Round:      l.Round,
+			BestOf:     l.BestOf,
+		}
+		for i, p := range l.Players {
+			if p != nil {
+				info.Players++
+				info.HP[i] = p.State.HP
+				info.Bot = info.Bot || p.bot
+			}
+		}
+		info.InProgress = info.Players == 2 && !l.StartTime.IsZero()
+		if info.InProgress {
+			info.ElapsedMs = time.Since(l.StartTime).Milliseconds()
+		} else {
+			info.ElapsedMs = time.Since(l.CreatedAt).Milliseconds()
+		}
+		l.mu.Unlock()
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// CLIENT
+
+// httpBase turns a websocket server URL into the matching HTTP base URL for
+// the JSON endpoints.
+func httpBase(server string) string {
+	u, err := url.Parse(server)
+	if err != nil {
+		return server
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = "/"
+	u.RawQuery = ""
+	return u.String()
+}
+
+func fetchLobbies(server string) ([]LobbyInfo, error) {
+	resp, err := http.Get(httpBase(server) + "lobbies")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var infos []LobbyInfo
+	if err := json.NewDecoder(resp.Body).Decode(&infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// lobbyRefresh is how often the browser re-fetches the lobby list.
+const lobbyRefresh = 2 * time.Second
+
+// BrowseLobbies lists the server's public lobbies and lets the player join
+// or watch one. It hands off to the game once something is picked.
+func BrowseLobbies(server string) {
+	s := newScreen()
+	g := &Game{screen: s}
+
+	inputChan := make(chan *tcell.EventKey, 10)
+	stopInput := make(chan struct{})
+	go func() {
+		for {
+			ev := s.PollEvent()
+			if ev == nil {
+				return
+			}
+			if key, ok := ev.(*tcell.EventKey); ok {
+				select {
+				case inputChan <- key:
+				case <-stopInput:
+					return
+				}
+			}
+		}
+	}()
+
+	var infos []LobbyInfo
+	var fetchErr error
+	selected := 0
+	refresh := func() {
+		infos, fetchErr = fetchLobbies(server)
+		selected = max(0, min(selected, len(infos)-1))
+	}
+	refresh()
+
+	ticker := time.NewTicker(lobbyRefresh)
+	defer ticker.Stop()
+
+	// pick is what to do once the screen is torn down
+	var pick func()
+	for pick == nil {
+		g.drawLobbies(infos, selected, fetchErr)
+
+		select {
+		case <-ticker.C:
+			refresh()
+		case ev := <-inputChan:
+			r := ev.Rune()
+			switch {
+			case ev.Key() == tcell.KeyEscape || ev.Key() == tcell.KeyCtrlC || r == 'q' || r == 'Q':
+				close(stopInput)
+				s.Fini()
+				return
+			case ev.Key() == tcell.KeyUp || r == 'w' || r == 'k':
+				selected = max(0, selected-1)
+			case ev.Key() == tcell.KeyDown || r == 's' || r == 'j':
+				selected = min(len(infos)-1, selected+1)
+			case r == 'r' || r == 'R':
+				refresh()
+			case r == 'n' || r == 'N':
+				// Quick match through the rated queue
+				pick = func() { StartClient(server) }
+			case len(infos) == 0:
+			case ev.Key() == tcell.KeyEnter:
+				// Join if there's a seat, otherwise watch
+				info := infos[selected]
+				id := strconv.Itoa(info.ID)
+				if info.Players < 2 {
+					pick = func() { StartClient(withQuery(server, "lobby", id)) }
+				} else {
+					pick = func() { StartSpectator(withQuery(server, "watch", id)) }
+				}
+			case r == 'v' || r == 'V':
+				id := strconv.Itoa(infos[selected].ID)
+				pick = func() { StartSpectator(withQuery(server, "watch", id)) }
+			}
+		}
+	}
+	close(stopInput)
+	s.Fini()
+	pick()
+}
+
+func (g *Game) drawLobbies(infos []LobbyInfo, selected int, fetchErr error) {
+	g.screen.Clear()
+	dim := tcell.StyleDefault.Foreground(tcell.ColorDarkGray)
+	put := func(x, y int, text string, style tcell.Style) {
+		for i, r := range text {
+			g.screen.SetContent(x+i, y, r, nil, style)
+		}
+	}
+
+	put(arenaLeft, 0, "=== LOBBIES ===", tcell.StyleDefault.Bold(true))
+	header := fmt.Sprintf(" %-6s %-8s %-10s %-9s %-11s %s", "Lobby", "Players", "Status", "Time", "HP", "Watching")
+	put(arenaLeft, 2, header, dim)
+	put(arenaLeft, 3, strings.Repeat("─", len(header)), dim)
+
+	switch {
+	case fetchErr != nil:
+		put(arenaLeft, 4, "Error fetching lobbies: "+fetchErr.Error(), tcell.StyleDefault.Foreground(tcell.ColorRed))
+	case len(infos) == 0:
+		put(arenaLeft, 4, "No open lobbies. Press N for a quick match!", tcell.StyleDefault)
+	}
+
+	for i, info := range infos {
+		status := "waiting"
+		hp := "-"
+		if info.InProgress {
+			status = "fighting"
+			if info.BestOf > 1 {
+				status = fmt.Sprintf("R%d of %d", info.Round, info.BestOf)
+			}
+			hp = fmt.Sprintf("%d / %d", info.HP[0], info.HP[1])
+		}
+		elapsed := fmt.Sprintf("%.0fs", float64(info.ElapsedMs)/1000.0)
+		players := fmt.Sprintf("%d/2", info.Players)
+		if info.Bot {
+			players += " bot"
+		}
+		line := fmt.Sprintf(" %-6d %-8s %-10s %-9s %-11s %d", info.ID, players, status, elapsed, hp, info.Spectators)
+
+		style := tcell.StyleDefault
+		if i == selected {
+			style = style.Reverse(true)
+		}
+		put(arenaLeft, 4+i, line, style)
+	}
+
+	_, h := g.screen.Size()
+	put(arenaLeft, h-1, "↑/↓ select  Enter join (or watch if full)  V watch  N quick match  R refresh  Q quit", dim)
+	g.screen.Show()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListLobbies(t *testing.T) {
+	savedLobbies := lobbies
+	defer func() { lobbies = savedLobbies }()
+
+	fighting, _, _ := fightingPair()
+	fighting.ID = 1
+	fighting.Players[1].bot = true
+
+	waiting := &Lobby{ID: 2, BestOf: 3, CreatedAt: time.Now().Add(-time.Minute)}
+	waiting.Players[0] = &Player{State: RemoteState{HP: 100}}
+
+	private, _, _ := fightingPair()
+	private.ID, private.Code = 3, "ABCDE"
+
+	lobbies = []*Lobby{fighting, waiting, private}
+	infos := listLobbies()
+	if len(infos) != 2 {
+		t.Fatalf("listed %d lobbies, want the 2 public ones: %+v", len(infos), infos)
+	}
+	for _, info := range infos {
+		if info.ID == private.ID {
+			t.Errorf("private room listed as %+v", info)
+		}
+	}
+
+	f, w := infos[0], infos[1]
+	if f.ID != 1 || f.Players != 2 || !f.InProgress || !f.Bot || f.HP != [2]int{100, 100} {
+		t.Errorf("fighting lobby listed as %+v", f)
+	}
+	if f.ElapsedMs < 5000 || f.ElapsedMs > 6000 {
+		t.Errorf("fighting lobby elapsed %dms, want the fight's ~5000ms", f.ElapsedMs)
+	}
+	if w.ID != 2 || w.Players != 1 || w.InProgress || w.Bot || w.BestOf != 3 {
+		t.Errorf("waiting lobby listed as %+v", w)
+	}
+	if w.ElapsedMs < 60000 {
+		t.Errorf("waiting lobby elapsed %dms, want the minute it's waited", w.ElapsedMs)
+	}
+}
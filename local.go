@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// localMatch is a hot-seat duel for two players sharing one keyboard:
+// Blue on WASD and Space, Red on the arrow keys and Enter. Hits follow the
+// server's rules, so it plays just like online.
+type localMatch struct {
+	g       *Game
+	knights [2]fighter
+	moves   [2]map[rune]bool // moves pressed since the last tick
+	swing   [2]bool
+	slashAt [2]time.Time
+	wins    [2]int
+	winner  int // index of the round's winner, -1 while fighting
+}
+
+// StartLocal runs `duel local` until either player quits.
+func StartLocal() {
+	m := &localMatch{g: &Game{screen: newScreen()}}
+	defer m.g.screen.Fini()
+	m.moves[0], m.moves[1] = make(map[rune]bool), make(map[rune]bool)
+	m.startRound()
+
+	inputChan := make(chan *tcell.EventKey, 10)
+	go func() {
+		for {
+			ev := m.g.screen.PollEvent()
+			if ev == nil {
+				return
+			}
+			if key, ok := ev.(*tcell.EventKey); ok {
+				inputChan <- key
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(tickRate)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-inputChan:
+			if isQuitKey(ev) {
+				return
+			}
+			if m.winner >= 0 {
+				if ev.Key() == tcell.KeyRune && (ev.Rune() == 'y' || ev.Rune() == 'Y') {
+					m.startRound()
+				}
+				continue
+			}
+			m.press(ev)
+
+		case now := <-ticker.C:
+			if m.winner < 0 {
+				m.tick(now)
+			}
+			m.draw(now)
+		}
+	}
+}
+
+// press hands a key to whichever player it belongs to, for the next tick.
+func (m *localMatch) press(ev *tcell.EventKey) {
+	for i, key := range [2]rune{wasdKey(ev), arrowKey(ev)} {
+		switch key {
+		case 0:
+		case ' ':
+			m.swing[i] = true
+		default:
+			m.moves[i][key] = true
+		}
+	}
+}
+
+func (m *localMatch) startRound() {
+	m.knights[0].spawn(10, 'd')
+	m.knights[1].spawn(65, 'a')
+	m.winner = -1
+}
+
+// tick moves both knights one step and resolves their swings.
+func (m *localMatch) tick(now time.Time) {
+	for i := range m.knights {
+		k := &m.knights[i]
+		// Same order as online, so sideways moves set the facing
+		for _, dir := range "wsad" {
+			if !m.moves[i][dir] {
+				continue
+			}
+			switch dir {
+			case 'w':
+				k.y--
+			case 's':
+				k.y++
+			case 'a':
+				k.x--
+			case 'd':
+				k.x++
+			}
+			k.facing = dir
+			m.moves[i][dir] = false
+		}
+		k.x, k.y = clampToArena(k.x, k.y)
+	}
+
+	for i := range m.knights {
+		if !m.swing[i] {
+			continue
+		}
+		m.swing[i] = false
+		me, enemy := &m.knights[i], &m.knights[1-i]
+		if me.hp == 0 {
+			continue
+		}
+		swung, _ := strike(me, enemy, now)
+		if swung {
+			m.slashAt[i] = now
+		}
+		if enemy.hp == 0 && m.winner < 0 {
+			m.winner = i
+			m.wins[i]++
+		}
+	}
+}
+
+func (m *localMatch) draw(now time.Time) {
+	g := m.g
+	g.screen.Clear()
+	g.drawArena()
+
+	slashDuration := 150 * time.Millisecond
+	flashDuration := 200 * time.Millisecond
+	centerX := (arenaLeft + arenaRight) / 2
+
+	for i := range m.knights {
+		k := &m.knights[i]
+		style := tcell.StyleDefault.Foreground(knightColors[i])
+		if now.Sub(k.lastHit) < flashDuration {
+			style = style.Foreground(tcell.ColorWhite)
+		}
+		g.drawCharacter(k.x, k.y, k.facing, style)
+	}
+	// Sword slashes on top of both knights
+	for i := range m.knights {
+		k := &m.knights[i]
+		if now.Sub(m.slashAt[i]) < slashDuration {
+			g.drawSword(k.x, k.y, k.facing, tcell.StyleDefault.Foreground(knightColors[i]))
+		}
+	}
+
+	// HP for both sides, like the spectator HUD
+	for i := range m.knights {
+		line := fmt.Sprintf("%s: %d HP", knightNames[i], m.knights[i].hp)
+		for j, r := range line {
+			g.screen.SetContent(centerX-len(line)/2+j, i, r, nil, tcell.StyleDefault.Foreground(knightColors[i]))
+		}
+	}
+
+	header := fmt.Sprintf("Local duel  %d-%d", m.wins[0], m.wins[1])
+	for i, r := range header {
+		g.screen.SetContent(arenaLeft+5+i, 0, r, nil, tcell.StyleDefault.Foreground(tcell.ColorDarkGray))
+	}
+
+	if m.winner >= 0 {
+		banner := fmt.Sprintf("%s WINS", knightNames[m.winner])
+		for i, r := range banner {
+			g.screen.SetContent(centerX-len(banner)/2+i, (arenaTop+arenaBottom)/2-4, r, nil, tcell.StyleDefault.Foreground(knightColors[m.winner]).Bold(true))
+		}
+		prompt := "Y to fight again, Q to quit"
+		for i, r := range prompt {
+			g.screen.SetContent(centerX-len(prompt)/2+i, (arenaTop+arenaBottom)/2-2, r, nil, tcell.StyleDefault)
+		}
+	}
+
+	_, h := g.screen.Size()
+	hint := "Blue: WASD + Space   Red: arrows + Enter   Q quit"
+	for i, r := range hint {
+		g.screen.SetContent(i, h-1, r, nil, tcell.StyleDefault.Foreground(tcell.ColorDarkGray))
+	}
+	g.screen.Show()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// newLocalMatch starts a hot-seat round without a screen.
+func newLocalMatch() *localMatch {
+	m := &localMatch{}
+	m.moves[0], m.moves[1] = make(map[rune]bool), make(map[rune]bool)
+	m.startRound()
+	return m
+}
+
+func TestLocalKeyRouting(t *testing.T) {
+	tests := []struct {
+		name      string
+		keys      []*tcell.EventKey
+		wantMoves [2]string // pressed moves, in "wsad" order
+		wantSwing [2]bool
+	}{
+		{"blue moves", []*tcell.EventKey{tcell.NewEventKey(tcell.KeyRune, 'w', 0), tcell.NewEventKey(tcell.KeyRune, 'd', 0)}, [2]string{"wd", ""}, [2]bool{}},
+		{"blue caps lock", []*tcell.EventKey{tcell.NewEventKey(tcell.KeyRune, 'S', 0)}, [2]string{"s", ""}, [2]bool{}},
+		{"red moves", []*tcell.EventKey{tcell.NewEventKey(tcell.KeyUp, 0, 0), tcell.NewEventKey(tcell.KeyLeft, 0, 0)}, [2]string{"", "wa"}, [2]bool{}},
+		{"blue swings", []*tcell.EventKey{tcell.NewEventKey(tcell.KeyRune, ' ', 0)}, [2]string{}, [2]bool{true, false}},
+		{"red swings", []*tcell.EventKey{tcell.NewEventKey(tcell.KeyEnter, 0, 0)}, [2]string{}, [2]bool{false, true}},
+		{"both at once", []*tcell.EventKey{tcell.NewEventKey(tcell.KeyRune, 'a', 0), tcell.NewEventKey(tcell.KeyDown, 0, 0), tcell.NewEventKey(tcell.KeyEnter, 0, 0)}, [2]string{"a", "s"}, [2]bool{false, true}},
+		{"other keys", []*tcell.EventKey{tcell.NewEventKey(tcell.KeyRune, 'x', 0), tcell.NewEventKey(tcell.KeyTab, 0, 0)}, [2]string{}, [2]bool{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newLocalMatch()
+			for _, ev := range tt.keys {
+				m.press(ev)
+			}
+			for i := range m.moves {
+				got := ""
+				for _, dir := range "wsad" {
+					if m.moves[i][dir] {
+						got += string(dir)
+					}
+				}
+				if got != tt.wantMoves[i] {
+					t.Errorf("%s pressed %q, want %q", knightNames[i], got, tt.wantMoves[i])
+				}
+			}
+			if m.swing != tt.wantSwing {
+				t.Errorf("swings = %v, want %v", m.swing, tt.wantSwing)
+			}
+		})
+	}
+}
+
+func TestLocalTick(t *testing.T) {
+	m := newLocalMatch()
+	m.knights[0].x, m.knights[1].x, m.knights[1].y = 20, 24, 13
+	m.press(tcell.NewEventKey(tcell.KeyRune, 'd', 0))
+	m.press(tcell.NewEventKey(tcell.KeyUp, 0, 0))
+	m.tick(time.Now())
+
+	blue, red := m.knights[0], m.knights[1]
+	if blue.x != 21 || blue.y != 12 || blue.facing != 'd' {
+		t.Errorf("blue at (%d, %d) facing %c, want (21, 12) facing d", blue.x, blue.y, blue.facing)
+	}
+	if red.x != 24 || red.y != 12 || red.facing != 'w' {
+		t.Errorf("red at (%d, %d) facing %c, want (24, 12) facing w", red.x, red.y, red.facing)
+	}
+	if m.moves[0]['d'] || m.moves[1]['w'] {
+		t.Error("moves still pressed after the tick")
+	}
+
+	// Blue's sword reaches red; red's swing goes the wrong way
+	m.knights[1].facing = 'd'
+	m.press(tcell.NewEventKey(tcell.KeyRune, ' ', 0))
+	m.press(tcell.NewEventKey(tcell.KeyEnter, 0, 0))
+	m.tick(time.Now())
+	if m.knights[1].hp != 100-attackDamage || m.knights[0].hp != 100 {
+		t.Errorf("HP blue %d, red %d; want 100 and %d", m.knights[0].hp, m.knights[1].hp, 100-attackDamage)
+	}
+	if m.swing != [2]bool{} {
+		t.Error("swings still pending after the tick")
+	}
+}
+
+func TestLocalKnockout(t *testing.T) {
+	m := newLocalMatch()
+	m.knights[0].x, m.knights[1].x = 20, 23
+	m.knights[1].hp = attackDamage
+	m.press(tcell.NewEventKey(tcell.KeyRune, ' ', 0))
+	m.tick(time.Now())
+	if m.winner != 0 || m.wins != [2]int{1, 0} {
+		t.Fatalf("winner %d with wins %v, want blue with [1 0]", m.winner, m.wins)
+	}
+
+	m.startRound()
+	if m.winner != -1 || m.knights[1].hp != 100 {
+		t.Errorf("new round has winner %d and red at %d HP", m.winner, m.knights[1].hp)
+	}
+	if m.wins != [2]int{1, 0} {
+		t.Errorf("wins reset to %v by a new round", m.wins)
+	}
+}
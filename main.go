@@ -2,10 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const defaultServer = "wss://cli-duel.fly.dev/"
@@ -22,7 +26,20 @@ func main() {
 	switch os.Args[1] {
 	case "host":
 		// Run local server for LAN play
-		StartServer()
+		fs := flag.NewFlagSet("host", flag.ExitOnError)
+		var cfg ServerConfig
+		storage := envOr("DUEL_STORAGE", os.Getenv("DUEL_LEADERBOARD"))
+		fs.StringVar(&cfg.Storage, "storage", storage, "storage backend for the leaderboard, ratings, registered names and match history: memory, file or upstash")
+		fs.StringVar(&cfg.Storage, "leaderboard", storage, "old name for -storage")
+		fs.StringVar(&cfg.LeaderboardFile, "leaderboard-file", envOr("DUEL_LEADERBOARD_FILE", "highscores.json"), "file used by the file leaderboard")
+		fs.StringVar(&cfg.RatingsFile, "ratings-file", envOr("DUEL_RATINGS_FILE", "ratings.json"), "file used for player ratings by the file backend")
+		fs.StringVar(&cfg.IdentitiesFile, "identities-file", envOr("DUEL_IDENTITIES_FILE", "identities.json"), "file used for registered names by the file backend")
+		fs.StringVar(&cfg.HistoryFile, "history-file", envOr("DUEL_HISTORY_FILE", "history.jsonl"), "file used for match history by the file backend")
+		fs.StringVar(&cfg.ReplayDir, "replay-dir", os.Getenv("DUEL_REPLAY_DIR"), "directory to record a replay of every series to; not recorded if empty")
+		fs.DurationVar(&cfg.BotFill, "bot-fill", envDuration("DUEL_BOT_FILL", 30*time.Second), "how long a quick match waits before a bot steps in, 0 to never")
+		fs.IntVar(&cfg.BestOf, "best-of", envInt("DUEL_BEST_OF", 1), "rounds per match: 1, 3, 5...")
+		fs.Parse(os.Args[2:])
+		StartServer(cfg)
 	case "join":
 		// Join custom server
 		if len(os.Args) < 3 {
@@ -30,20 +47,171 @@ func main() {
 			return
 		}
 		StartClient(os.Args[2])
+	case "create":
+		// Open a private room on the default (or given) server
+		fs := flag.NewFlagSet("create", flag.ExitOnError)
+		bestOf := fs.Int("best-of", 1, "rounds per match: 1, 3, 5...")
+		fs.Parse(os.Args[2:])
+		server := defaultServer
+		if fs.NArg() > 0 {
+			server = fs.Arg(0)
+		}
+		url := roomURL(server, "new")
+		if *bestOf > 1 {
+			url = withQuery(url, "best_of", strconv.Itoa(*bestOf))
+		}
+		StartClient(url)
+	case "join-room":
+		// Join a private room by code
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: duel join-room CODE [ws://server:port]")
+			return
+		}
+		server := defaultServer
+		if len(os.Args) > 3 {
+			server = os.Args[3]
+		}
+		StartClient(roomURL(server, os.Args[2]))
+	case "watch":
+		// Spectate a lobby by ID, or whatever fight is on
+		id := ""
+		if len(os.Args) > 2 {
+			id = os.Args[2]
+		}
+		server := defaultServer
+		if len(os.Args) > 3 {
+			server = os.Args[3]
+		}
+		StartSpectator(withQuery(server, "watch", id))
+	case "lobbies":
+		// Browse public lobbies to join or watch
+		server := defaultServer
+		if len(os.Args) > 2 {
+			server = os.Args[2]
+		}
+		BrowseLobbies(server)
+	case "replay":
+		// Play back a recorded match offline
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: duel replay FILE")
+			return
+		}
+		PlayReplay(os.Args[2])
+	case "export":
+		// Turn a replay, or a match played now, into a shareable clip
+		fs := flag.NewFlagSet("export", flag.ExitOnError)
+		format := fs.String("format", "asciicast", "output format; only asciicast is supported")
+		out := fs.String("o", "", "output file (default: the replay's name with .cast, or duel.cast)")
+		live := fs.Bool("live", false, "record a match played now instead of a replay")
+		fs.Parse(os.Args[2:])
+		if *format != "asciicast" {
+			fmt.Printf("Unsupported export format %q\n", *format)
+			return
+		}
+
+		var err error
+		if *live {
+			server := defaultServer
+			if fs.NArg() > 0 {
+				server = fs.Arg(0)
+			}
+			if *out == "" {
+				*out = "duel.cast"
+			}
+			err = exportLive(server, *out)
+		} else {
+			if fs.NArg() < 1 {
+				fmt.Println("Usage: duel export --format asciicast [-o OUT] FILE")
+				fmt.Println("       duel export --format asciicast --live [-o OUT] [ws://server:port]")
+				return
+			}
+			if *out == "" {
+				*out = strings.TrimSuffix(fs.Arg(0), filepath.Ext(fs.Arg(0))) + ".cast"
+			}
+			err = exportReplay(fs.Arg(0), *out)
+		}
+		if err != nil {
+			fmt.Println("Export failed:", err)
+			return
+		}
+		fmt.Println("Wrote", *out)
+	case "practice":
+		// Fight an offline bot
+		level := "normal"
+		if len(os.Args) > 2 {
+			level = os.Args[2]
+		}
+		StartPractice(level)
+	case "local":
+		// Two players, one keyboard
+		StartLocal()
+	case "history":
+		// Show a player's record, defaulting to our own registered name
+		name := ""
+		if len(os.Args) > 2 {
+			name = os.Args[2]
+		} else if id, err := loadIdentity(); err == nil {
+			name = id.Name
+		}
+		if name == "" {
+			fmt.Println("Usage: duel history NAME [ws://server:port]")
+			return
+		}
+		server := defaultServer
+		if len(os.Args) > 3 {
+			server = os.Args[3]
+		}
+		showHistory(server, name)
 	case "-h", "--highscores", "highscores":
 		// Show high scores leaderboard
 		showHighScores()
 	default:
 		fmt.Println("Usage:")
-		fmt.Println("  duel             - Join online match")
-		fmt.Println("  duel host        - Host local server")
-		fmt.Println("  duel join URL    - Join custom server")
-		fmt.Println("  duel -h          - Show top 10 fastest takedowns")
+		fmt.Println("  duel                     - Join online match")
+		fmt.Println("  duel host                - Host local server")
+		fmt.Println("  duel join URL            - Join custom server")
+		fmt.Println("  duel create              - Open a private room and get a code")
+		fmt.Println("  duel create --best-of 3  - Private room, first to win 2 rounds")
+		fmt.Println("  duel join-room CODE      - Join a private room")
+		fmt.Println("  duel watch [LOBBY]       - Spectate a match")
+		fmt.Println("  duel lobbies             - Browse lobbies to join or watch")
+		fmt.Println("  duel practice [LEVEL]    - Fight an offline bot: easy, normal or hard")
+		fmt.Println("  duel local               - Two players on one keyboard")
+		fmt.Println("  duel history [NAME]      - Show a player's recent matches")
+		fmt.Println("  duel replay FILE         - Play back a recorded match")
+		fmt.Println("  duel export FILE         - Convert a replay to an asciinema .cast")
+		fmt.Println("  duel -h                  - Show top 10 fastest takedowns")
+	}
+}
+
+// envInt returns the environment variable key as an int, or fallback if
+// it's unset or not a number.
+func envInt(key string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return n
+	}
+	return fallback
+}
+
+// envDuration returns the environment variable key as a duration like
+// "30s", or fallback if it's unset or malformed.
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return d
+	}
+	return fallback
+}
+
+// envOr returns the environment variable key, or fallback if it's unset.
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
 	}
+	return fallback
 }
 
 func showHighScores() {
-	fmt.Println("\n=== FASTEST TAKEDOWNS ===\n")
+	fmt.Print("\n=== FASTEST TAKEDOWNS ===\n\n")
 
 	resp, err := http.Get(defaultHTTPServer + "highscores")
 	if err != nil {
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Matchmaking tuning. A queued player accepts opponents within
+// baseRatingGap of their rating, widening by ratingGapPerSecond while they
+// wait so nobody queues forever.
+const (
+	matchInterval      = 500 * time.Millisecond
+	baseRatingGap      = 100
+	ratingGapPerSecond = 25
+)
+
+// queueEntry is a player waiting in the matchmaking queue.
+type queueEntry struct {
+	player    *Player
+	since     time.Time
+	botCalled bool // a bot is on its way
+}
+
+// queue holds players waiting for a rated match. Guarded by lobbyMu.
+var queue []*queueEntry
+
+// allowedGap is how far from their own rating e will accept an opponent.
+func (e *queueEntry) allowedGap(now time.Time) int {
+	return baseRatingGap + int(now.Sub(e.since).Seconds()*ratingGapPerSecond)
+}
+
+// enqueue adds a player to the matchmaking queue and tries to pair them
+// straight away. It returns how many players are now online.
+func enqueue(p *Player) int {
+	lobbyMu.Lock()
+	defer lobbyMu.Unlock()
+	queue = append(queue, &queueEntry{player: p, since: time.Now()})
+	totalPlayers++
+	matchQueue()
+	return totalPlayers
+}
+
+// dequeue removes a player who left before being matched. Caller must hold
+// lobbyMu.
+func dequeue(p *Player) {
+	for i, e := range queue {
+		if e.player == p {
+			queue = append(queue[:i], queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// runMatchmaker periodically pairs queued players as their acceptable
+// rating gaps widen.
+func runMatchmaker() {
+	for range time.Tick(matchInterval) {
+		lobbyMu.Lock()
+		matchQueue()
+		callBots()
+		lobbyMu.Unlock()
+	}
+}
+
+// matchQueue pairs neighbouring players by rating when either of them will
+// accept the gap, and seats each pair in a new lobby. Caller must hold
+// lobbyMu.
+func matchQueue() {
+	if len(queue) < 2 {
+		return
+	}
+	sort.SliceStable(queue, func(i, j int) bool {
+		return queue[i].player.rating < queue[j].player.rating
+	})
+
+	now := time.Now()
+	remaining := queue[:0]
+	for i := 0; i < len(queue); i++ {
+		if i+1 < len(queue) {
+			a, b := queue[i], queue[i+1]
+			gap := b.player.rating - a.player.rating
+			// Two clients sharing an identity never play each other
+			sameName := a.player.name != "" && strings.EqualFold(a.player.name, b.player.name)
+			if !sameName && gap <= max(a.allowedGap(now), b.allowedGap(now)) {
+				seatMatch(a.player, b.player)
+				i++
+				continue
+			}
+		}
+		remaining = append(remaining, queue[i])
+	}
+	// Clear the tail so matched players can be collected
+	for i := len(remaining); i < len(queue); i++ {
+		queue[i] = nil
+	}
+	queue = remaining
+}
+
+// seatMatch puts two queued players in a fresh public lobby and starts the
+// fight. Caller must hold lobbyMu.
+func seatMatch(a, b *Player) {
+	lobby := newLobby("", config.BestOf)
+	lobby.mu.Lock()
+	defer lobby.mu.Unlock()
+
+	a.State.Player1, b.State.Player1 = true, false
+	lobby.Players = [2]*Player{a, b}
+	a.Lobby, b.Lobby = lobby, lobby
+	fmt.Printf("Matched %d vs %d in lobby %d\n", a.rating, b.rating, lobby.ID)
+	startSeries(lobby)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// queued makes a queue entry for a player with the given name and rating
+// who has waited for wait.
+func queued(name string, rating int, wait time.Duration) *queueEntry {
+	p := &Player{
+		name:   name,
+		rating: rating,
+		send:   make(chan frame, playerQueueSize),
+		done:   make(chan struct{}),
+	}
+	return &queueEntry{player: p, since: time.Now().Add(-wait)}
+}
+
+func TestMatchQueue(t *testing.T) {
+	tests := []struct {
+		name        string
+		queue       []*queueEntry
+		wantPairs   [][2]string // by name, lower rating first
+		wantWaiting []string
+	}{
+		{
+			name:        "alone",
+			queue:       []*queueEntry{queued("a", 1500, 0)},
+			wantWaiting: []string{"a"},
+		},
+		{
+			name:      "close ratings",
+			queue:     []*queueEntry{queued("a", 1500, 0), queued("b", 1580, 0)},
+			wantPairs: [][2]string{{"a", "b"}},
+		},
+		{
+			name:        "gap too wide",
+			queue:       []*queueEntry{queued("a", 1500, 0), queued("b", 1800, 0)},
+			wantWaiting: []string{"a", "b"},
+		},
+		{
+			name:      "gap widens while waiting",
+			queue:     []*queueEntry{queued("a", 1500, 0), queued("b", 1800, 10*time.Second)},
+			wantPairs: [][2]string{{"a", "b"}},
+		},
+		{
+			name: "neighbours by rating",
+			queue: []*queueEntry{
+				queued("high", 2000, 0), queued("low", 1200, 0),
+				queued("high2", 2050, 0), queued("low2", 1250, 0),
+			},
+			wantPairs: [][2]string{{"low", "low2"}, {"high", "high2"}},
+		},
+		{
+			name:        "same identity never paired",
+			queue:       []*queueEntry{queued("alice", 1500, 0), queued("ALICE", 1500, 0)},
+			wantWaiting: []string{"alice", "ALICE"},
+		},
+		{
+			name:      "anonymous players paired",
+			queue:     []*queueEntry{queued("", 1500, 0), queued("", 1500, 0)},
+			wantPairs: [][2]string{{"", ""}},
+		},
+	}
+
+	savedQueue, savedLobbies, savedConfig := queue, lobbies, config
+	defer func() { queue, lobbies, config = savedQueue, savedLobbies, savedConfig }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue, lobbies, config = tt.queue, nil, ServerConfig{BestOf: 1}
+			matchQueue()
+
+			if len(lobbies) != len(tt.wantPairs) {
+				t.Fatalf("%d lobbies opened, want %d", len(lobbies), len(tt.wantPairs))
+			}
+			for i, l := range lobbies {
+				got := [2]string{l.Players[0].name, l.Players[1].name}
+				if got != tt.wantPairs[i] {
+					t.Errorf("lobby %d seats %q, want %q", i, got, tt.wantPairs[i])
+				}
+				for _, p := range l.Players {
+					if p.Lobby != l {
+						t.Errorf("player %q not pointed at their lobby", p.name)
+					}
+				}
+			}
+			if len(queue) != len(tt.wantWaiting) {
+				t.Fatalf("%d left waiting, want %d", len(queue), len(tt.wantWaiting))
+			}
+			for i, e := range queue {
+				if e.player.name != tt.wantWaiting[i] {
+					t.Errorf("waiting[%d] = %q, want %q", i, e.player.name, tt.wantWaiting[i])
+				}
+			}
+		})
+	}
+}
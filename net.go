@@ -1,11 +1,14 @@
 package main
 
 import (
-	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -16,25 +19,81 @@ import (
 )
 
 type RemoteState struct {
-	X            int  `json:"x"`
-	Y            int  `json:"y"`
-	HP           int  `json:"hp"`
-	Attack       bool `json:"attack"`
-	Facing       rune `json:"facing"`
-	Player1      bool `json:"player1"`
-	TotalPlayers int  `json:"total_players,omitempty"`
+	Seq     uint32 `json:"seq,omitempty"` // client's input sequence number, echoed back in StateAck
+	X       int    `json:"x"`
+	Y       int    `json:"y"`
+	HP      int    `json:"hp"`
+	Attack  bool   `json:"attack"`
+	Facing  rune   `json:"facing"`
+	Player1 bool   `json:"player1"`
 }
 
+// MatchResult ends a round. In a best-of-N series the match is only over
+// once SeriesOver is set; until then another round follows.
 type MatchResult struct {
-	Type       string `json:"type"` // "match_result"
 	Won        bool   `json:"won"`
 	DurationMs int64  `json:"duration_ms"`
+	Token      string `json:"token,omitempty"` // one-time high score token, series winner only
+
+	Round      int   `json:"round"`
+	BestOf     int   `json:"best_of"`
+	Wins       int   `json:"wins"`
+	EnemyWins  int   `json:"enemy_wins"`
+	SeriesOver bool  `json:"series_over"`
+	Forfeit    bool  `json:"forfeit,omitempty"`   // the opponent disconnected mid-series
+	SeriesMs   int64 `json:"series_ms,omitempty"` // every round's fighting time, once the series is over
+
+	Rating       int `json:"rating,omitempty"` // new rating, rated players only
+	RatingChange int `json:"rating_change,omitempty"`
+}
+
+// HealthUpdate carries the server's authoritative HP for both sides of a
+// lobby, from the point of view of the receiving player.
+type HealthUpdate struct {
+	HP      int `json:"hp"`
+	EnemyHP int `json:"enemy_hp"`
+}
+
+// StateAck tells a client which of its states the server has processed and
+// where that left it, so the client can reconcile its prediction.
+type StateAck struct {
+	Seq uint32 `json:"seq"`
+	X   int    `json:"x"`
+	Y   int    `json:"y"`
+}
+
+// QueueInfo tells a player they're waiting for a rated match.
+type QueueInfo struct {
+	Rating int `json:"rating"`
+}
+
+// RoomInfo tells the creator of a private room the code to share.
+type RoomInfo struct {
+	Code string `json:"code"`
+}
+
+// ErrorMessage is sent before closing a connection the server refused, or
+// in reply to a request it turned down.
+type ErrorMessage struct {
+	Message string `json:"message"`
 }
 
+// Disconnected is passed to the game, never sent, when the connection to
+// the server is lost.
+type Disconnected struct{}
+
+// HighScoreSubmit claims a leaderboard entry for a won match. The duration
+// isn't sent; the server uses its own measurement for the match the token
+// was issued for.
 type HighScoreSubmit struct {
-	Type       string `json:"type"` // "highscore_submit"
 	PlayerName string `json:"player_name"`
-	DurationMs int64  `json:"duration_ms"`
+	Token      string `json:"token"`
+}
+
+// HighScoreAccepted confirms a HighScoreSubmit, with the name the score
+// was saved under. A refused submission gets an ErrorMessage instead.
+type HighScoreAccepted struct {
+	PlayerName string `json:"player_name"`
 }
 
 type HighScore struct {
@@ -50,122 +109,301 @@ var upgrader = websocket.Upgrader{
 type Player struct {
 	Conn  *websocket.Conn
 	State RemoteState
-	Lobby *Lobby
-}
+	Lobby *Lobby // nil while waiting in the matchmaking queue
 
-type Lobby struct {
-	ID         int
-	Players    [2]*Player
-	StartTime  time.Time
-	MatchEnded bool
-	mu         sync.Mutex
+	name   string // empty for anonymous players, who aren't rated
+	rating int
+	token  string // identity token presented on connect, if any
+	bot    bool   // one of the server's own bots filling the queue
+
+	lastAttack time.Time // last accepted attack, for the server-side cooldown
+	lastHit    time.Time // last time this player took damage
+	hits       int       // hits landed this round, for match history
+
+	moveBudget float64   // cells this player may still move, refilled every tick
+	lastMoveAt time.Time // when moveBudget was last refilled
+	violations int       // illegal moves seen from this connection
+
+	scoreToken      string // outstanding high score token from a won match
+	scoreDurationMs int64  // server-measured duration that token is good for
+
+	wantsRematch bool        // accepted a rematch after the last match ended
+	lastResult   MatchResult // last round's result, resent on a reconnect during the break
+
+	session string    // lets a dropped connection reclaim this seat
+	away    bool      // disconnected mid-series, seat held for reconnectGrace
+	holds   int       // times the seat has been held this series
+	awayAt  time.Time // when the seat was last held
+	binary  bool      // connection agreed to binary frames for per-tick messages
+
+	// Outbound messages, written by the player's own writer goroutine
+	// since a websocket allows only one writer at a time
+	send      chan frame
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
+// Player connection tuning. A player whose queue fills up, or whose
+// connection takes longer than playerWriteWait to accept a message, is
+// dropped instead of holding up the lobby.
+const (
+	playerQueueSize = 128
+	playerWriteWait = 2 * time.Second
+)
+
+// Keepalive for player connections. The server pings every pingPeriod and
+// each side gives up on a peer it hasn't heard from in pongWait, so a
+// half-open connection doesn't leave a knight frozen forever. Variables so
+// tests can shorten them.
 var (
-	lobbies        []*Lobby
-	lobbyMu        sync.Mutex
-	nextLobbyID    int
-	totalPlayers   int
-	upstashURL     string
-	upstashToken   string
-	redisConnected bool
+	pingPeriod = 2 * time.Second
+	pongWait   = 3 * pingPeriod
 )
 
-func initRedis() {
-	upstashURL = os.Getenv("UPSTASH_REDIS_REST_URL")
-	upstashToken = os.Getenv("UPSTASH_REDIS_REST_TOKEN")
-	if upstashURL == "" || upstashToken == "" {
-		fmt.Println("Warning: UPSTASH_REDIS_REST_URL or UPSTASH_REDIS_REST_TOKEN not set, high scores disabled")
+func newPlayer(c *websocket.Conn) *Player {
+	p := &Player{rating: defaultRating}
+	p.attach(c)
+	return p
+}
+
+// attach gives the player a connection and starts its writer. On a
+// reconnect the caller must hold lobby.mu, since broadcasts may be sending
+// to the player meanwhile.
+func (p *Player) attach(c *websocket.Conn) {
+	p.Conn = c
+	p.send = make(chan frame, playerQueueSize)
+	p.done = make(chan struct{})
+	p.closeOnce = sync.Once{}
+	go writeLoop(c, p.send, p.done)
+}
+
+// sendMessage queues v for the player without blocking, in the encoding
+// their connection agreed on. A player too far behind to take it is
+// disconnected.
+func (p *Player) sendMessage(v interface{}) {
+	f, err := encodeFrame(v, p.binary)
+	if err != nil {
 		return
 	}
-	redisConnected = true
-	fmt.Println("Connected to Upstash Redis")
+	p.sendFrame(f)
 }
 
-func upstashRequest(command []interface{}) (interface{}, error) {
-	if !redisConnected {
-		return nil, fmt.Errorf("redis not connected")
+// sendFrame queues an already encoded message, for broadcasts that encode
+// once for everyone.
+func (p *Player) sendFrame(f frame) {
+	select {
+	case p.send <- f:
+	default:
+		// Too far behind to catch up, so don't wait to flush the queue
+		p.closeOnce.Do(func() {
+			fmt.Printf("Dropping %s: too far behind\n", p.Conn.RemoteAddr())
+			close(p.done)
+			p.Conn.Close()
+		})
 	}
-	body, _ := json.Marshal(command)
-	req, _ := http.NewRequest("POST", upstashURL, bytes.NewBuffer(body))
-	req.Header.Set("Authorization", "Bearer "+upstashToken)
-	req.Header.Set("Content-Type", "application/json")
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+// close sends whatever is already queued and then closes the connection,
+// which ends the player's read loop. Safe to call more than once.
+func (p *Player) close() {
+	p.closeOnce.Do(func() { close(p.done) })
+}
 
-	respBody, _ := io.ReadAll(resp.Body)
-	var result struct {
-		Result interface{} `json:"result"`
-		Error  string      `json:"error"`
+// writeLoop writes a player's queued messages to c until done, taking c
+// and the queue rather than the player so a reconnect can't swap them out
+// from under it.
+func writeLoop(c *websocket.Conn, send <-chan frame, done <-chan struct{}) {
+	defer c.Close()
+	write := func(msg frame) bool {
+		c.SetWriteDeadline(time.Now().Add(playerWriteWait))
+		return c.WriteMessage(msg.kind, msg.data) == nil
 	}
-	json.Unmarshal(respBody, &result)
-	if result.Error != "" {
-		return nil, fmt.Errorf(result.Error)
+	ping := time.NewTicker(pingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case msg := <-send:
+			if !write(msg) {
+				return
+			}
+		case <-ping.C:
+			if c.WriteControl(websocket.PingMessage, nil, time.Now().Add(playerWriteWait)) != nil {
+				return
+			}
+		case <-done:
+			for {
+				select {
+				case msg := <-send:
+					if !write(msg) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
 	}
-	return result.Result, nil
 }
 
-func submitHighScore(playerName string, durationMs int64) error {
-	if !redisConnected {
-		return fmt.Errorf("redis not connected")
+// Movement limits enforced by the server. A client moves at most one cell
+// per axis each tick; maxMoveBurst lets a few ticks' worth of movement
+// arrive together after network jitter.
+const (
+	maxMoveBurst      = 4.0
+	violationLogEvery = 10
+)
+
+// validateMove checks a client-reported position against the arena bounds
+// and the one-cell-per-tick speed limit, and returns the position the
+// server accepts.
+func (p *Player) validateMove(x, y int) (int, int) {
+	now := time.Now()
+	p.moveBudget += float64(now.Sub(p.lastMoveAt)) / float64(tickRate)
+	p.moveBudget = min(p.moveBudget, maxMoveBurst)
+	p.lastMoveAt = now
+
+	nx, ny := clampToArena(x, y)
+	legal := nx == x && ny == y
+
+	// Distance in ticks: diagonal moves cost one tick, like on the client
+	dx, dy := nx-p.State.X, ny-p.State.Y
+	allowed := int(p.moveBudget)
+	if max(abs(dx), abs(dy)) > allowed {
+		legal = false
+		dx = max(-allowed, min(dx, allowed))
+		dy = max(-allowed, min(dy, allowed))
+		nx, ny = p.State.X+dx, p.State.Y+dy
 	}
-	// Use sorted set with duration as score (lower is better)
-	// Member format: "playerName:timestamp" for uniqueness
-	member := fmt.Sprintf("%s:%d", playerName, time.Now().UnixNano())
-	_, err := upstashRequest([]interface{}{"ZADD", "highscores", durationMs, member})
-	return err
+	p.moveBudget -= float64(max(abs(dx), abs(dy)))
+
+	if !legal {
+		p.violations++
+		if p.violations%violationLogEvery == 0 {
+			fmt.Printf("Player %s flagged: %d illegal moves\n", p.Conn.RemoteAddr(), p.violations)
+		}
+	}
+	return nx, ny
 }
 
-func getTopScores(limit int) ([]HighScore, error) {
-	if !redisConnected {
-		return nil, fmt.Errorf("redis not connected")
+func abs(n int) int {
+	if n < 0 {
+		return -n
 	}
-	result, err := upstashRequest([]interface{}{"ZRANGE", "highscores", "0", strconv.Itoa(limit - 1), "WITHSCORES"})
-	if err != nil {
-		return nil, err
+	return n
+}
+
+type Lobby struct {
+	ID         int
+	Code       string // private room code, empty for the public queue
+	Players    [2]*Player
+	CreatedAt  time.Time
+	StartTime  time.Time
+	MatchEnded bool // current round is over
+	mu         sync.Mutex
+
+	BestOf     int    // rounds in the series, 1 for a single fight
+	Round      int    // current round, counting from 1
+	RoundWins  [2]int // indexed like Players
+	SeriesOver bool
+	roundDue   bool  // the break ended while a seat was held
+	seriesMs   int64 // fighting time so far this series, breaks not counted
+
+	Spectators map[*Spectator]struct{}
+
+	replay *replayRecorder // current series recording, nil when not recording
+}
+
+// hasOpenSlot reports whether another player can join.
+func (l *Lobby) hasOpenSlot() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Players[0] == nil || l.Players[1] == nil
+}
+
+// seat returns p's index in Players. Caller must hold l.mu.
+func (l *Lobby) seat(p *Player) int {
+	if l.Players[1] == p {
+		return 1
 	}
+	return 0
+}
 
-	// Result is an array of [member, score, member, score, ...]
-	arr, ok := result.([]interface{})
-	if !ok {
-		return nil, fmt.Errorf("unexpected response format")
-	}
-
-	scores := make([]HighScore, 0)
-	for i := 0; i < len(arr); i += 2 {
-		member := arr[i].(string)
-		scoreStr := arr[i+1].(string)
-		score, _ := strconv.ParseInt(scoreStr, 10, 64)
-
-		// Parse "playerName:timestamp" format
-		parts := strings.Split(member, ":")
-		playerName := parts[0]
-		if len(parts) > 2 {
-			// Handle names with colons by rejoining all but last part
-			playerName = strings.Join(parts[:len(parts)-1], ":")
-		}
-		scores = append(scores, HighScore{
-			Rank:       len(scores) + 1,
-			PlayerName: playerName,
-			DurationMs: score,
-		})
+// opponent returns the other player in the lobby, or nil if p is alone.
+// Caller must hold l.mu.
+func (l *Lobby) opponent(p *Player) *Player {
+	for _, other := range l.Players {
+		if other != nil && other != p {
+			return other
+		}
 	}
-	return scores, nil
+	return nil
+}
+
+var (
+	lobbies      []*Lobby
+	lobbyMu      sync.Mutex
+	nextLobbyID  int
+	totalPlayers int
+	leaderboard  LeaderboardStore
+	ratings      RatingStore
+	identities   IdentityStore
+	history      HistoryStore
+	config       ServerConfig
+)
+
+// ServerConfig holds the options for `duel host`.
+type ServerConfig struct {
+	Storage         string        // backend for every server store: "memory", "file", "upstash" or "" to pick automatically
+	LeaderboardFile string        // path used by the file backend
+	RatingsFile     string        // path used by the file backend for player ratings
+	IdentitiesFile  string        // path used by the file backend for name ownership
+	HistoryFile     string        // path used by the file backend for match history
+	ReplayDir       string        // where to write a replay of every series, "" to not record
+	BotFill         time.Duration // how long a queued player waits before getting a bot, 0 for never
+	BestOf          int           // rounds per series in lobbies that don't ask for their own
 }
 
+// serverAddr is where the server listens.
+const serverAddr = ":8080"
+
 // SERVER
-func StartServer() {
-	initRedis()
+func StartServer(cfg ServerConfig) {
+	store, err := newLeaderboardStore(cfg.Storage, cfg.LeaderboardFile)
+	if err != nil {
+		fmt.Println("Leaderboard error:", err)
+		return
+	}
+	leaderboard = store
+	ratings, err = newRatingStore(cfg.Storage, cfg.RatingsFile)
+	if err != nil {
+		fmt.Println("Ratings error:", err)
+		return
+	}
+	identities, err = newIdentityStore(cfg.Storage, cfg.IdentitiesFile)
+	if err != nil {
+		fmt.Println("Identities error:", err)
+		return
+	}
+	history, err = newHistoryStore(cfg.Storage, cfg.HistoryFile)
+	if err != nil {
+		fmt.Println("History error:", err)
+		return
+	}
+	botSecret, err = newMatchToken()
+	if err != nil {
+		fmt.Println("Bot secret error:", err)
+		return
+	}
+	if !validBestOf(cfg.BestOf) {
+		cfg.BestOf = 1
+	}
+	config = cfg
 
 	// High scores API endpoint
 	http.HandleFunc("/highscores", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		scores, err := getTopScores(10)
+		scores, err := leaderboard.Top(10)
 		if err != nil {
 			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 			return
@@ -173,201 +411,711 @@ func StartServer() {
 		json.NewEncoder(w).Encode(scores)
 	})
 
+	// Match history endpoint
+	http.HandleFunc("/history", serveHistory)
+
+	// Lobby browser endpoint
+	http.HandleFunc("/lobbies", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(w).Encode(listLobbies())
+	})
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		c, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			fmt.Println("Upgrade error:", err)
 			return
 		}
-		player := &Player{Conn: c}
-
-		// Find or create a lobby
-		lobbyMu.Lock()
-		var lobby *Lobby
-		for _, l := range lobbies {
-			l.mu.Lock()
-			if l.Players[1] == nil {
-				// Found a waiting lobby
-				lobby = l
-				player.State.Player1 = false
-				lobby.Players[1] = player
-				player.Lobby = lobby
-				lobby.StartTime = time.Now() // Match begins when both players join
-				l.mu.Unlock()
-				break
+		hello, ok := greet(c)
+		if !ok {
+			return
+		}
+		if r.URL.Query().Has("watch") {
+			// Spectators share one encoding of each broadcast, so get JSON
+			watchLobby(c, r.URL.Query().Get("watch"))
+			return
+		}
+		useBinary := agreeEncoding(c, hello)
+		if isBotRequest(r.URL.Query().Get("bot")) {
+			bot := newPlayer(c)
+			bot.bot = true
+			bot.binary = useBinary
+			if !seatBot(bot) {
+				bot.sendMessage(ErrorMessage{Message: "nobody is waiting for a bot"})
+				bot.close()
+				return
+			}
+			go handlePlayer(bot)
+			return
+		}
+		if session := r.URL.Query().Get("session"); session != "" {
+			// Back from a dropped connection
+			if !resumeSession(c, session, useBinary) {
+				writeMessage(c, ErrorMessage{Message: "that match is over"})
+				c.Close()
+			}
+			return
+		}
+		req := parseJoinRequest(r.URL.Query())
+		player := newPlayer(c)
+		player.binary = useBinary
+		player.name, player.token = req.Name, identityToken(r)
+		if player.name != "" {
+			// Names belong to whoever claimed them first
+			if err := claimName(player.name, player.token); err != nil {
+				player.sendMessage(ErrorMessage{Message: err.Error()})
+				player.close()
+				return
+			}
+			if rating, err := ratings.Get(player.name); err == nil {
+				player.rating = rating
+			} else {
+				fmt.Println("Failed to load rating:", err)
 			}
-			l.mu.Unlock()
 		}
 
-		if lobby == nil {
-			// Create new lobby
-			lobby = &Lobby{ID: nextLobbyID}
-			nextLobbyID++
+		if req.Room == "" && req.LobbyID == "" {
+			// Rated queue: start on the left in an empty arena until the
+			// matchmaker seats us; round_start moves us if needed
 			player.State.Player1 = true
-			lobby.Players[0] = player
-			player.Lobby = lobby
-			lobbies = append(lobbies, lobby)
+			player.spawn()
+			player.sendMessage(player.State)
+			player.sendMessage(QueueInfo{Rating: player.rating})
+			startSession(player)
+			online := enqueue(player)
+			fmt.Printf("Player queued (rating %d) - %d online\n", player.rating, online)
+			broadcastPlayerCount()
+			go handlePlayer(player)
+			return
 		}
-		totalPlayers++
-		lobbyMu.Unlock()
 
-		// Initialize player position before any broadcasts
-		if player.State.Player1 {
-			player.State.X = 10
-			player.State.Y = 12
-			player.State.HP = 100
-		} else {
-			player.State.X = 65
-			player.State.Y = 12
-			player.State.HP = 100
+		lobby, online, err := joinLobby(player, req)
+		if err != nil {
+			player.sendMessage(ErrorMessage{Message: err.Error()})
+			player.close()
+			return
 		}
+
+		// Initialize player position before any broadcasts
+		player.spawn()
 		// Send initial state to the new player first
-		player.Conn.WriteJSON(player.State)
+		player.sendMessage(player.State)
+		if lobby.Code != "" && player.State.Player1 {
+			player.sendMessage(RoomInfo{Code: lobby.Code})
+		}
+		startSession(player)
 
-		fmt.Printf("Player joined lobby %d (player1: %v) - %d online\n", lobby.ID, player.State.Player1, totalPlayers)
+		fmt.Printf("Player joined lobby %d (player1: %v) - %d online\n", lobby.ID, player.State.Player1, online)
 		broadcastPlayerCount()
+
+		// Match begins when both players join; the matchmaker starts its
+		// own matches
+		lobby.mu.Lock()
+		if lobby.Players[0] != nil && lobby.Players[1] != nil {
+			startSeries(lobby)
+		}
+		lobby.mu.Unlock()
 		go handlePlayer(player)
 	})
 
-	fmt.Println("Server running on :8080")
-	http.ListenAndServe(":8080", nil)
+	go runMatchmaker()
+
+	fmt.Println("Server running on " + serverAddr)
+	http.ListenAndServe(serverAddr, nil)
 }
 
-func handlePlayer(p *Player) {
-	lobby := p.Lobby
+// joinRequest is what a connecting player asked for in the URL query.
+type joinRequest struct {
+	Room    string // "" for the rated queue, "new" to open a private room, or a room code
+	LobbyID string // a specific public lobby, as picked from the lobby browser
+	BestOf  int    // series length when opening a private room
+	Name    string // player name for ratings, empty to play unrated
+}
 
-	defer func() {
-		p.Conn.Close()
-		lobby.mu.Lock()
-		// Remove player from lobby
-		if lobby.Players[0] == p {
-			lobby.Players[0] = nil
-		} else if lobby.Players[1] == p {
-			lobby.Players[1] = nil
-		}
-		// Clean up empty lobbies
-		if lobby.Players[0] == nil && lobby.Players[1] == nil {
-			lobbyMu.Lock()
-			for i, l := range lobbies {
-				if l == lobby {
-					lobbies = append(lobbies[:i], lobbies[i+1:]...)
-					break
-				}
-			}
-			lobbyMu.Unlock()
+func parseJoinRequest(q url.Values) joinRequest {
+	req := joinRequest{
+		Room:    q.Get("room"),
+		LobbyID: q.Get("lobby"),
+		BestOf:  config.BestOf,
+	}
+	if name := q.Get("name"); validPlayerName(name) {
+		req.Name = name
+	}
+	if n, err := strconv.Atoi(q.Get("best_of")); err == nil && validBestOf(n) {
+		req.BestOf = n
+	}
+	return req
+}
+
+// identityToken returns the identity token a client sent in its
+// Authorization header, or "" if there isn't a usable one.
+func identityToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || len(token) > 128 {
+		return ""
+	}
+	return token
+}
+
+// claimName binds name to the player's identity token, or explains why
+// they can't use it.
+func claimName(name, token string) error {
+	if token == "" {
+		return fmt.Errorf("playing as %q needs an identity; update your client", name)
+	}
+	err := identities.Claim(name, token)
+	if errors.Is(err, errNameTaken) {
+		return fmt.Errorf("the name %q is registered to another player", name)
+	}
+	return err
+}
+
+// validPlayerName reports whether name fits the leaderboard: 1-12 letters,
+// digits, '_' or '-'.
+func validPlayerName(name string) bool {
+	if len(name) < 1 || len(name) > 12 {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return false
 		}
-		lobby.mu.Unlock()
+	}
+	return true
+}
 
-		lobbyMu.Lock()
-		totalPlayers--
-		fmt.Printf("Player left lobby %d - %d online\n", lobby.ID, totalPlayers)
-		lobbyMu.Unlock()
-		broadcastPlayerCount()
-	}()
+// joinLobby seats player in the private room or specific lobby they asked
+// for, and returns it with how many players are now online. The rated queue
+// is handled by the matchmaker instead.
+func joinLobby(player *Player, req joinRequest) (*Lobby, int, error) {
+	lobbyMu.Lock()
+	defer lobbyMu.Unlock()
+
+	var lobby *Lobby
+	switch room := req.Room; {
+	case req.LobbyID != "":
+		n, err := strconv.Atoi(req.LobbyID)
+		if err == nil {
+			lobby = findLobby(n)
+		}
+		if lobby == nil || lobby.Code != "" {
+			return nil, 0, fmt.Errorf("lobby %s not found", req.LobbyID)
+		}
+		if !lobby.hasOpenSlot() {
+			return nil, 0, fmt.Errorf("lobby %d is full", lobby.ID)
+		}
+	case room == "new":
+		code, err := newRoomCode()
+		if err != nil {
+			return nil, 0, fmt.Errorf("couldn't open a room: %w", err)
+		}
+		lobby = newLobby(code, req.BestOf)
+		fmt.Printf("Private room %s opened in lobby %d\n", lobby.Code, lobby.ID)
+	default:
+		lobby = findRoom(room)
+		if lobby == nil {
+			return nil, 0, fmt.Errorf("room %s not found", strings.ToUpper(room))
+		}
+		if !lobby.hasOpenSlot() {
+			return nil, 0, fmt.Errorf("room %s is full", lobby.Code)
+		}
+	}
 
-	// If both players are in the lobby, send each other's state
 	lobby.mu.Lock()
-	if lobby.Players[0] != nil && lobby.Players[1] != nil {
-		lobby.Players[0].Conn.WriteJSON(lobby.Players[1].State)
-		lobby.Players[1].Conn.WriteJSON(lobby.Players[0].State)
+	if lobby.Players[0] == nil {
+		player.State.Player1 = true
+		lobby.Players[0] = player
+	} else {
+		player.State.Player1 = false
+		lobby.Players[1] = player
 	}
+	player.Lobby = lobby
 	lobby.mu.Unlock()
 
+	totalPlayers++
+	return lobby, totalPlayers, nil
+}
+
+// newLobby creates and registers an empty lobby. Caller must hold lobbyMu.
+func newLobby(code string, bestOf int) *Lobby {
+	lobby := &Lobby{ID: nextLobbyID, Code: code, BestOf: bestOf, CreatedAt: time.Now()}
+	nextLobbyID++
+	lobbies = append(lobbies, lobby)
+	return lobby
+}
+
+// findLobby returns the open lobby with the given ID. Caller must hold
+// lobbyMu.
+func findLobby(id int) *Lobby {
+	for _, l := range lobbies {
+		if l.ID == id {
+			return l
+		}
+	}
+	return nil
+}
+
+func handlePlayer(p *Player) {
+	lobby := p.currentLobby()
+
+	p.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	p.Conn.SetPongHandler(func(string) error {
+		return p.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	// A player who quits says so; any other way of losing them may be a
+	// network blip worth waiting out
+	quit := false
+	defer func() {
+		p.close()
+		if !quit && holdSeat(p) {
+			return
+		}
+		p.leave()
+	}()
+
 	for {
-		// Read raw message to determine type
-		_, rawMsg, err := p.Conn.ReadMessage()
+		kind, rawMsg, err := p.Conn.ReadMessage()
 		if err != nil {
+			quit = websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
 			return
 		}
+		p.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		msg, err := decodeFrame(kind, rawMsg)
+		if err != nil {
+			continue
+		}
 
-		// Check if it's a high score submission
-		var msgType struct {
-			Type string `json:"type"`
+		// Pick up the lobby the matchmaker seated us in
+		if lobby == nil {
+			lobby = p.currentLobby()
 		}
-		json.Unmarshal(rawMsg, &msgType)
 
-		if msgType.Type == "highscore_submit" {
-			var submit HighScoreSubmit
-			if json.Unmarshal(rawMsg, &submit) == nil {
-				handleHighScoreSubmit(submit.PlayerName, submit.DurationMs)
+		var st RemoteState
+		switch msg := msg.(type) {
+		case HighScoreSubmit:
+			if lobby != nil {
+				handleHighScoreSubmit(p, msg)
+			}
+			continue
+		case RematchRequest:
+			if lobby != nil {
+				handleRematch(p, msg.Accept)
 			}
 			continue
+		case RemoteState:
+			st = msg
+		default:
+			continue
 		}
 
-		// Otherwise treat as game state
-		var st RemoteState
-		if json.Unmarshal(rawMsg, &st) != nil {
-			continue
+		if lobby == nil {
+			// Still queued: keep our knight moving in its empty arena. The
+			// matchmaker may have seated us since we last looked, in which
+			// case our state belongs to the lobby now.
+			lobbyMu.Lock()
+			if lobby = p.Lobby; lobby == nil {
+				x, y := p.validateMove(st.X, st.Y)
+				p.State.X, p.State.Y, p.State.Facing = x, y, st.Facing
+				lobbyMu.Unlock()
+				p.sendMessage(StateAck{Seq: st.Seq, X: x, Y: y})
+				continue
+			}
+			lobbyMu.Unlock()
 		}
 
-		p.State.X = st.X
-		p.State.Y = st.Y
-		p.State.HP = st.HP
-		p.State.Attack = st.Attack
-		p.State.Facing = st.Facing
+		// HP is owned by the server; only movement and intent come from the client
+		lobby.mu.Lock()
+		x, y := p.validateMove(st.X, st.Y)
+		p.State.X, p.State.Y, p.State.Facing = x, y, st.Facing
+		lobby.mu.Unlock()
+		p.sendMessage(StateAck{Seq: st.Seq, X: x, Y: y})
 
-		broadcastToLobby(lobby, p)
+		attack := st.Attack && resolveAttack(lobby, p)
+		broadcastToLobby(lobby, p, attack)
+	}
+}
 
-		// Detect win condition: this player's HP reached 0
-		lobby.mu.Lock()
-		if p.State.HP <= 0 && !lobby.MatchEnded && !lobby.StartTime.IsZero() {
-			lobby.MatchEnded = true
-			durationMs := time.Since(lobby.StartTime).Milliseconds()
-
-			// Find opponent (the winner)
-			var winner *Player
-			for _, player := range lobby.Players {
-				if player != nil && player != p {
-					winner = player
+// leave takes the player out of the queue or their lobby for good.
+func (p *Player) leave() {
+	lobbyMu.Lock()
+	delete(sessions, p.session)
+	lobby := p.Lobby
+	if lobby == nil {
+		dequeue(p)
+		totalPlayers--
+		fmt.Printf("Player left the queue - %d online\n", totalPlayers)
+	}
+	lobbyMu.Unlock()
+	if lobby == nil {
+		broadcastPlayerCount()
+		return
+	}
+
+	lobby.mu.Lock()
+	// Leaving mid-series forfeits it to whoever's still here. If they're
+	// away themselves, their seat has nothing left to reconnect to.
+	var abandoned string
+	if other := lobby.opponent(p); other != nil && !other.bot && lobby.Round > 0 && !lobby.SeriesOver {
+		fmt.Printf("Player left lobby %d mid-series\n", lobby.ID)
+		if lobby.MatchEnded {
+			// Between rounds: the last one is already scored
+			forfeitSeries(lobby, other, p)
+		} else {
+			endRound(lobby, other, p, true)
+		}
+		if other.away {
+			abandoned = other.session
+		}
+	}
+	// Remove player from lobby
+	if lobby.Players[0] == p {
+		lobby.Players[0] = nil
+	} else if lobby.Players[1] == p {
+		lobby.Players[1] = nil
+	}
+	// An unfinished series ends here
+	lobby.stopReplay()
+	// A bot has no one left to play
+	if other := lobby.opponent(p); other != nil && other.bot {
+		other.close()
+	}
+	// Anyone waiting on a rematch with us isn't getting one
+	if other := lobby.opponent(p); other != nil && lobby.SeriesOver {
+		other.wantsRematch = false
+		other.sendMessage(RematchDeclined{})
+	}
+	lobby.broadcastSpectators(lobby.snapshot(nil))
+	empty := lobby.Players[0] == nil && lobby.Players[1] == nil
+	if empty {
+		lobby.closeSpectators()
+	}
+	lobby.mu.Unlock()
+
+	// lobbyMu is always taken before lobby.mu, never while holding it
+	if empty || abandoned != "" {
+		lobbyMu.Lock()
+		if abandoned != "" {
+			delete(sessions, abandoned)
+		}
+		// Clean up empty lobbies, unless someone was seated in the gap
+		if empty {
+			lobby.mu.Lock()
+			empty = lobby.Players[0] == nil && lobby.Players[1] == nil
+			lobby.mu.Unlock()
+		}
+		if empty {
+			for i, l := range lobbies {
+				if l == lobby {
+					lobbies = append(lobbies[:i], lobbies[i+1:]...)
 					break
 				}
 			}
+		}
+		lobbyMu.Unlock()
+	}
 
-			// Send match results to both players
-			if winner != nil {
-				// Winner gets the duration for high score submission
-				winner.Conn.WriteJSON(MatchResult{
-					Type:       "match_result",
-					Won:        true,
-					DurationMs: durationMs,
-				})
-				fmt.Printf("Match ended in lobby %d - duration: %dms\n", lobby.ID, durationMs)
-			}
-			// Loser just gets notified they lost
-			p.Conn.WriteJSON(MatchResult{
-				Type:       "match_result",
-				Won:        false,
-				DurationMs: durationMs,
-			})
+	if p.bot {
+		return
+	}
+	lobbyMu.Lock()
+	totalPlayers--
+	fmt.Printf("Player left lobby %d - %d online\n", lobby.ID, totalPlayers)
+	lobbyMu.Unlock()
+	broadcastPlayerCount()
+}
+
+// currentLobby returns the player's lobby, or nil while they're queued.
+func (p *Player) currentLobby() *Lobby {
+	lobbyMu.Lock()
+	defer lobbyMu.Unlock()
+	return p.Lobby
+}
+
+// resolveAttack applies an attack from attacker against its opponent using
+// the server's copy of both positions. It returns false if the attack was
+// rejected by the cooldown, in which case it shouldn't be shown to anyone.
+func resolveAttack(lobby *Lobby, attacker *Player) bool {
+	lobby.mu.Lock()
+	defer lobby.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(attacker.lastAttack) < attackCooldown-cooldownSlack {
+		return false
+	}
+	attacker.lastAttack = now
+
+	target := lobby.opponent(attacker)
+	// No one can be hurt while a seat is held for a reconnect
+	if target == nil || target.away || lobby.MatchEnded || lobby.StartTime.IsZero() {
+		return true
+	}
+	if now.Sub(target.lastHit) < hitInvulnerability {
+		return true
+	}
+	if !canHit(attacker.State.X, attacker.State.Y, attacker.State.Facing, target.State.X, target.State.Y) {
+		return true
+	}
+
+	target.State.HP -= attackDamage
+	if target.State.HP < 0 {
+		target.State.HP = 0
+	}
+	target.lastHit = now
+	attacker.hits++
+
+	// Both sides learn the new HP straight away so hits register without
+	// waiting for the next state broadcast
+	attacker.sendMessage(HealthUpdate{HP: attacker.State.HP, EnemyHP: target.State.HP})
+	target.sendMessage(HealthUpdate{HP: target.State.HP, EnemyHP: attacker.State.HP})
+	lobby.broadcastSpectators(target.State)
+	lobby.replay.state(target.State)
+
+	if target.State.HP <= 0 {
+		endRound(lobby, attacker, target, false)
+	}
+	return true
+}
+
+// endRound scores a knockout and sends round results to both players. If
+// that decides the series the winner gets a high score token; otherwise the
+// next round starts after a short break. Caller must hold lobby.mu.
+func endRound(lobby *Lobby, winner, loser *Player, forfeit bool) {
+	lobby.MatchEnded = true
+	endedAt := time.Now()
+	durationMs := endedAt.Sub(lobby.StartTime).Milliseconds()
+	lobby.seriesMs += durationMs
+	lobby.RoundWins[lobby.seat(winner)]++
+	lobby.SeriesOver = forfeit || lobby.RoundWins[lobby.seat(winner)] >= lobby.BestOf/2+1
+
+	// Every round counts towards rating, as long as both players are named
+	var ratingChange [2]int
+	if winner.name != "" && loser.name != "" {
+		newWinner, newLoser := eloUpdate(winner.rating, loser.rating)
+		ratingChange[lobby.seat(winner)] = newWinner - winner.rating
+		ratingChange[lobby.seat(loser)] = newLoser - loser.rating
+		winner.rating, loser.rating = newWinner, newLoser
+		saveRating(winner.name, newWinner)
+		saveRating(loser.name, newLoser)
+	}
+
+	result := func(p *Player) MatchResult {
+		r := MatchResult{
+			Won:        p == winner,
+			DurationMs: durationMs,
+			Round:      lobby.Round,
+			BestOf:     lobby.BestOf,
+			Wins:       lobby.RoundWins[lobby.seat(p)],
+			EnemyWins:  lobby.RoundWins[1-lobby.seat(p)],
+			SeriesOver: lobby.SeriesOver,
+			Forfeit:    forfeit,
 		}
-		lobby.mu.Unlock()
+		if lobby.SeriesOver {
+			r.SeriesMs = lobby.seriesMs
+		}
+		if ratingChange[lobby.seat(p)] != 0 {
+			r.Rating = p.rating
+			r.RatingChange = ratingChange[lobby.seat(p)]
+		}
+		return r
+	}
+	winnerResult := result(winner)
+
+	// Winner gets a one-time token to claim a high score for the whole
+	// series, unless it was against a bot or never finished
+	if lobby.SeriesOver && !forfeit && !winner.bot && !loser.bot {
+		token, err := newMatchToken()
+		if err != nil {
+			fmt.Println("Failed to issue match token:", err)
+		}
+		winner.scoreToken = token
+		winner.scoreDurationMs = lobby.seriesMs
+		winnerResult.Token = token
+	}
+	winner.lastResult, loser.lastResult = winnerResult, result(loser)
+	winner.sendMessage(winner.lastResult)
+	loser.sendMessage(loser.lastResult)
+	lobby.broadcastSpectators(lobby.snapshot(winner))
+	lobby.replay.result(result(lobby.Players[0]))
+
+	go saveMatch(MatchRecord{
+		LobbyID:    lobby.ID,
+		Round:      lobby.Round,
+		BestOf:     lobby.BestOf,
+		Winner:     winner.name,
+		Loser:      loser.name,
+		WinnerHits: winner.hits,
+		LoserHits:  loser.hits,
+		DurationMs: durationMs,
+		StartedAt:  lobby.StartTime,
+		EndedAt:    endedAt,
+		Bot:        winner.bot || loser.bot,
+		Forfeit:    forfeit,
+	})
+
+	if lobby.SeriesOver {
+		lobby.stopReplay()
+		fmt.Printf("Match ended in lobby %d - duration: %dms, rounds %d-%d\n", lobby.ID, lobby.seriesMs, lobby.RoundWins[0], lobby.RoundWins[1])
+		return
+	}
+	fmt.Printf("Round %d ended in lobby %d - duration: %dms\n", lobby.Round, lobby.ID, durationMs)
+	round := lobby.Round
+	time.AfterFunc(roundBreak, func() {
+		lobby.mu.Lock()
+		defer lobby.mu.Unlock()
+		// Skip if someone left or a rematch already moved things on
+		if lobby.Round != round || !lobby.MatchEnded || lobby.Players[0] == nil || lobby.Players[1] == nil {
+			return
+		}
+		// A held seat keeps the break going until its player is back
+		if lobby.Players[0].away || lobby.Players[1].away {
+			lobby.roundDue = true
+			return
+		}
+		startRound(lobby)
+	})
+}
+
+// forfeitSeries ends a series to winner when loser leaves between rounds.
+// The round just played has already been scored, so nothing more is
+// counted, rated or recorded in history. Caller must hold lobby.mu.
+func forfeitSeries(lobby *Lobby, winner, loser *Player) {
+	lobby.SeriesOver = true
+	result := func(p *Player) MatchResult {
+		return MatchResult{
+			Won:        p == winner,
+			Round:      lobby.Round,
+			BestOf:     lobby.BestOf,
+			Wins:       lobby.RoundWins[lobby.seat(p)],
+			EnemyWins:  lobby.RoundWins[1-lobby.seat(p)],
+			SeriesOver: true,
+			Forfeit:    true,
+		}
+	}
+	winner.sendMessage(result(winner))
+	loser.sendMessage(result(loser))
+	lobby.broadcastSpectators(lobby.snapshot(winner))
+	lobby.replay.result(result(lobby.Players[0]))
+	lobby.stopReplay()
+	fmt.Printf("Match forfeited in lobby %d between rounds, rounds %d-%d\n", lobby.ID, lobby.RoundWins[0], lobby.RoundWins[1])
+}
+
+// pendingRatings holds ratings waiting to be saved, by player name. While
+// a name has an entry, one goroutine is saving it. Guarded by
+// pendingRatingsMu.
+var (
+	pendingRatings   = map[string]int{}
+	pendingRatingsMu sync.Mutex
+)
 
-		// Clear one-time flags after broadcast
-		p.State.Attack = false
+// saveRating persists a rating off the lobby lock, since stores may be
+// remote. Saves for one player happen one at a time and the newest rating
+// always lands last, however quickly rounds end.
+func saveRating(name string, rating int) {
+	// One queue per player, however they typed their name this time
+	name = ratingKey(name)
+	pendingRatingsMu.Lock()
+	_, saving := pendingRatings[name]
+	pendingRatings[name] = rating
+	pendingRatingsMu.Unlock()
+	if !saving {
+		go flushRating(name)
 	}
 }
 
-// Handle high score submission from winner
-func handleHighScoreSubmit(playerName string, durationMs int64) {
-	if len(playerName) < 1 || len(playerName) > 12 {
+// flushRating saves name's pending rating until no newer one is waiting.
+func flushRating(name string) {
+	for {
+		pendingRatingsMu.Lock()
+		rating := pendingRatings[name]
+		pendingRatingsMu.Unlock()
+
+		if err := ratings.Set(name, rating); err != nil {
+			fmt.Println("Failed to save rating:", err)
+		}
+
+		pendingRatingsMu.Lock()
+		if pendingRatings[name] == rating {
+			delete(pendingRatings, name)
+			pendingRatingsMu.Unlock()
+			return
+		}
+		pendingRatingsMu.Unlock()
+	}
+}
+
+// newMatchToken returns a random token the winner must present to submit a
+// high score.
+func newMatchToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Handle high score submission from winner. The token is consumed whether
+// or not the submission succeeds, so each win can be claimed at most once.
+// The player is told either way, so the client only keeps a name the
+// server accepted.
+func handleHighScoreSubmit(p *Player, submit HighScoreSubmit) {
+	lobby := p.Lobby
+	lobby.mu.Lock()
+	token, durationMs := p.scoreToken, p.scoreDurationMs
+	p.scoreToken = ""
+	lobby.mu.Unlock()
+
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(submit.Token)) != 1 {
+		fmt.Printf("Rejected high score submission in lobby %d: invalid match token\n", lobby.ID)
+		p.sendMessage(ErrorMessage{Message: "that win can't be claimed"})
 		return
 	}
-	err := submitHighScore(playerName, durationMs)
-	if err != nil {
+	// Named players always score under their own name. Anyone else claims
+	// the name they typed, which then stays theirs.
+	playerName := p.name
+	if playerName == "" {
+		playerName = submit.PlayerName
+		if !validPlayerName(playerName) {
+			p.sendMessage(ErrorMessage{Message: fmt.Sprintf("%q isn't a valid name", playerName)})
+			return
+		}
+		if err := claimName(playerName, p.token); err != nil {
+			fmt.Printf("Rejected high score in lobby %d: %v\n", lobby.ID, err)
+			p.sendMessage(ErrorMessage{Message: err.Error()})
+			return
+		}
+		rating, err := ratings.Get(playerName)
+		if err != nil {
+			rating = defaultRating
+		}
+		lobby.mu.Lock()
+		p.name, p.rating = playerName, rating
+		lobby.mu.Unlock()
+	}
+	if err := leaderboard.Submit(playerName, durationMs); err != nil {
 		fmt.Println("Failed to submit high score:", err)
-	} else {
-		fmt.Printf("High score submitted: %s - %dms\n", playerName, durationMs)
+		p.sendMessage(ErrorMessage{Message: "the leaderboard couldn't save your score"})
+		return
 	}
+	fmt.Printf("High score submitted: %s - %dms\n", playerName, durationMs)
+	p.sendMessage(HighScoreAccepted{PlayerName: playerName})
 }
 
-func broadcastToLobby(lobby *Lobby, sender *Player) {
+// broadcastToLobby sends sender's state to everyone else in the lobby.
+// attack marks this state as carrying an accepted swing.
+func broadcastToLobby(lobby *Lobby, sender *Player, attack bool) {
 	lobby.mu.Lock()
 	defer lobby.mu.Unlock()
+	st := sender.State
+	st.Attack = attack
 	for _, p := range lobby.Players {
 		if p != nil && p != sender {
-			p.Conn.WriteJSON(sender.State)
+			p.sendMessage(st)
 		}
 	}
+	lobby.broadcastSpectators(st)
+	lobby.replay.state(st)
 }
 
 func broadcastPlayerCount() {
@@ -375,14 +1123,34 @@ func broadcastPlayerCount() {
 	count := totalPlayers
 	lobbyMu.Unlock()
 
-	msg := RemoteState{TotalPlayers: count}
+	// Encoded once per encoding, not once per player
+	msg := PlayerCount{Count: count}
+	text, err := encodeFrame(msg, false)
+	if err != nil {
+		return
+	}
+	bin, err := encodeFrame(msg, true)
+	if err != nil {
+		return
+	}
+	send := func(p *Player) {
+		switch {
+		case p == nil:
+		case p.binary:
+			p.sendFrame(bin)
+		default:
+			p.sendFrame(text)
+		}
+	}
 	lobbyMu.Lock()
+	// Players waiting for a rated match aren't in a lobby yet
+	for _, e := range queue {
+		send(e.player)
+	}
 	for _, lobby := range lobbies {
 		lobby.mu.Lock()
 		for _, p := range lobby.Players {
-			if p != nil {
-				p.Conn.WriteJSON(msg)
-			}
+			send(p)
 		}
 		lobby.mu.Unlock()
 	}
@@ -391,61 +1159,138 @@ func broadcastPlayerCount() {
 
 // CLIENT
 func StartClient(url string) {
-	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	// Named players are rated. The name is kept with the local identity
+	// and DUEL_NAME picks a new one.
+	id, err := loadIdentity()
+	if err != nil {
+		fmt.Println("Identity error:", err)
+		return
+	}
+	if name := os.Getenv("DUEL_NAME"); name != "" && name != id.Name {
+		id.Name = name
+		if err := id.save(); err != nil {
+			fmt.Println("Identity error:", err)
+		}
+	}
+	if id.Name != "" {
+		url = withQuery(url, "name", id.Name)
+	}
+	header := http.Header{"Authorization": {"Bearer " + id.serverToken(url)}}
+	c, _, err := websocket.DefaultDialer.Dial(url, header)
 	if err != nil {
 		fmt.Println("Connect error:", err)
 		return
 	}
-	defer c.Close()
+	// The reader swaps c for a new connection after reconnecting; connMu
+	// guards it, and the encoding it agreed on, against the game's writes
+	var connMu sync.Mutex
+	quitting := make(chan struct{})
+	defer func() {
+		// Say goodbye properly, so the server doesn't hold our seat
+		close(quitting)
+		connMu.Lock()
+		c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		c.Close()
+		connMu.Unlock()
+	}()
+
+	// The server pings us; hearing nothing at all for pongWait means it's gone
+	keepAlive(c)
 
 	netChan := make(chan RemoteState, 10)
-	matchResultChan := make(chan MatchResult, 1)
+	msgChan := make(chan interface{}, 10)
 
-	// Wait for initial role assignment
-	var isLeft bool
-	var st RemoteState
-	err = c.ReadJSON(&st)
+	// Say hello, then wait for our initial role
+	encodings := clientEncodings()
+	first, useBinary, err := handshake(c, encodings)
 	if err != nil {
-		fmt.Println("Failed to receive role:", err)
+		fmt.Println("Server refused connection:", err)
+		return
+	}
+	st, ok := first.(RemoteState)
+	if !ok {
+		fmt.Println("Failed to receive role")
 		return
 	}
-	isLeft = st.Player1
+	isLeft := st.Player1
 
 	game := NewGame(isLeft)
+	game.identity = id
+	game.playerName = id.Name
+	if path := os.Getenv("DUEL_RECORD"); path != "" {
+		startClientReplay(path, game)
+		defer game.recorder.Close()
+	}
 	// Set initial position from server
 	game.PlayerX = st.X
 	game.PlayerY = st.Y
 
 	go func() {
+		session := ""
 		for {
-			_, rawMsg, err := c.ReadMessage()
+			kind, rawMsg, err := c.ReadMessage()
 			if err != nil {
-				return
-			}
-
-			// Check message type
-			var msgType struct {
-				Type string `json:"type"`
+				select {
+				case <-quitting:
+					return
+				default:
+				}
+				if session == "" {
+					msgChan <- Disconnected{}
+					return
+				}
+				// Try to win our seat back before the server gives it up
+				msgChan <- Reconnecting{}
+				nc, binary, err := redial(url, header, session, encodings)
+				if err != nil {
+					msgChan <- Disconnected{}
+					return
+				}
+				keepAlive(nc)
+				connMu.Lock()
+				c.Close()
+				c, useBinary = nc, binary
+				connMu.Unlock()
+				msgChan <- Reconnected{}
+				continue
 			}
-			json.Unmarshal(rawMsg, &msgType)
+			c.SetReadDeadline(time.Now().Add(pongWait))
 
-			if msgType.Type == "match_result" {
-				var result MatchResult
-				if json.Unmarshal(rawMsg, &result) == nil {
-					matchResultChan <- result
-				}
+			msg, err := decodeFrame(kind, rawMsg)
+			if err != nil || msg == nil {
 				continue
 			}
 
-			// Otherwise it's a game state
-			var st RemoteState
-			if json.Unmarshal(rawMsg, &st) == nil {
-				netChan <- st
+			switch msg := msg.(type) {
+			case RemoteState:
+				// Drop states if the game isn't keeping up (e.g. on the
+				// result screen) rather than stall other messages behind
+				// them; a newer state will follow.
+				select {
+				case netChan <- msg:
+				default:
+				}
+			case SessionInfo:
+				session = msg.Token
+			case StateAck, HealthUpdate, PlayerCount:
+				// These pile up while the game sits on a result screen, and
+				// blocking on them would stop us answering pings. Each is
+				// overtaken by the next: a later ack covers every move
+				// before it, the next round resets HP, and the next join or
+				// leave sends another count.
+				select {
+				case msgChan <- msg:
+				default:
+				}
+			default:
+				msgChan <- msg
 			}
 		}
 	}()
 
-	game.Run(netChan, matchResultChan, func(msg interface{}) {
-		c.WriteJSON(msg)
+	game.Run(netChan, msgChan, func(msg interface{}) {
+		connMu.Lock()
+		defer connMu.Unlock()
+		writeEncoded(c, msg, useBinary)
 	})
 }
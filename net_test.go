@@ -0,0 +1,480 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestValidateMove(t *testing.T) {
+	tests := []struct {
+		name           string
+		fromX, fromY   int
+		budget         float64
+		idle           time.Duration // since the last move
+		toX, toY       int
+		wantX, wantY   int
+		wantViolations int
+	}{
+		{"one step", 20, 10, 1, 0, 21, 10, 21, 10, 0},
+		{"diagonal costs one step", 20, 10, 1, 0, 21, 11, 21, 11, 0},
+		{"standing still", 20, 10, 0, 0, 20, 10, 20, 10, 0},
+		{"no budget", 20, 10, 0, 0, 21, 10, 20, 10, 1},
+		{"teleport held to budget", 20, 10, 1, 0, 40, 5, 21, 9, 1},
+		{"burst after jitter", 20, 10, 0, 4 * tickRate, 24, 10, 24, 10, 0},
+		{"burst capped", 20, 10, 0, time.Hour, 40, 10, 24, 10, 1},
+		{"left wall", arenaLeft + 1, 10, 4, 0, arenaLeft - 5, 10, arenaLeft + 1, 10, 1},
+		{"bottom wall", 20, arenaBottom - 2, 4, 0, 20, arenaBottom, 20, arenaBottom - 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Player{moveBudget: tt.budget, lastMoveAt: time.Now().Add(-tt.idle)}
+			p.State.X, p.State.Y = tt.fromX, tt.fromY
+			x, y := p.validateMove(tt.toX, tt.toY)
+			if x != tt.wantX || y != tt.wantY {
+				t.Errorf("validateMove(%d, %d) from (%d, %d) = (%d, %d), want (%d, %d)",
+					tt.toX, tt.toY, tt.fromX, tt.fromY, x, y, tt.wantX, tt.wantY)
+			}
+			if p.violations != tt.wantViolations {
+				t.Errorf("violations = %d, want %d", p.violations, tt.wantViolations)
+			}
+		})
+	}
+}
+
+func TestValidateMoveSpendsBudget(t *testing.T) {
+	p := &Player{moveBudget: 2, lastMoveAt: time.Now()}
+	p.State.X, p.State.Y = 20, 10
+	for _, want := range []int{21, 22, 22} {
+		x, _ := p.validateMove(p.State.X+1, 10)
+		if x != want {
+			t.Fatalf("moved to x=%d, want %d", x, want)
+		}
+		p.State.X = x
+	}
+}
+
+func TestHighScoreTokenConsumed(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string // issued to the winner
+		submits []string
+		want    int // scores on the leaderboard afterwards
+	}{
+		{"valid token", "abc123", []string{"abc123"}, 1},
+		{"replayed token", "abc123", []string{"abc123", "abc123"}, 1},
+		{"wrong token", "abc123", []string{"nope"}, 0},
+		{"wrong then right", "abc123", []string{"nope", "abc123"}, 0},
+		{"no token issued", "", []string{""}, 0},
+	}
+	saved := leaderboard
+	defer func() { leaderboard = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &memoryLeaderboard{}
+			leaderboard = store
+			p := &Player{Lobby: &Lobby{}, name: "alice", scoreToken: tt.token, scoreDurationMs: 4200, send: make(chan frame, playerQueueSize)}
+			for _, token := range tt.submits {
+				handleHighScoreSubmit(p, HighScoreSubmit{PlayerName: "mallory", Token: token})
+			}
+			if accepted, refused := highScoreReplies(t, p); accepted != tt.want || refused != len(tt.submits)-tt.want {
+				t.Errorf("told %d accepted and %d refused, want %d and %d", accepted, refused, tt.want, len(tt.submits)-tt.want)
+			}
+			if p.scoreToken != "" {
+				t.Errorf("token %q still outstanding", p.scoreToken)
+			}
+			scores, _ := store.Top(10)
+			if len(scores) != tt.want {
+				t.Fatalf("%d scores submitted, want %d", len(scores), tt.want)
+			}
+			for _, s := range scores {
+				if s.PlayerName != "alice" || s.DurationMs != 4200 {
+					t.Errorf("submitted %+v, want alice at the server's 4200ms", s)
+				}
+			}
+		})
+	}
+}
+
+// highScoreReplies counts the high score submissions p was told were
+// accepted and refused.
+func highScoreReplies(t *testing.T, p *Player) (accepted, refused int) {
+	t.Helper()
+	for len(p.send) > 0 {
+		f := <-p.send
+		msg, err := decodeFrame(f.kind, f.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch msg.(type) {
+		case HighScoreAccepted:
+			accepted++
+		case ErrorMessage:
+			refused++
+		}
+	}
+	return accepted, refused
+}
+
+func TestHighScoreNameClaim(t *testing.T) {
+	tests := []struct {
+		name      string
+		submitted string
+		token     string // the submitter's identity token
+		wantSaved bool
+	}{
+		{"free name", "bob", "tok-b", true},
+		{"own name", "alice", "tok-a", true},
+		{"someone else's name", "ALICE", "tok-b", false},
+		{"no identity", "bob", "", false},
+		{"invalid name", "no spaces", "tok-b", false},
+	}
+	savedBoard, savedIDs, savedRatings := leaderboard, identities, ratings
+	defer func() { leaderboard, identities, ratings = savedBoard, savedIDs, savedRatings }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			board, ids := &memoryLeaderboard{}, &memoryIdentities{}
+			leaderboard, identities, ratings = board, ids, &memoryRatings{}
+			ids.Claim("alice", "tok-a")
+
+			p := &Player{Lobby: &Lobby{}, token: tt.token, scoreToken: "abc123", scoreDurationMs: 4200, send: make(chan frame, playerQueueSize)}
+			handleHighScoreSubmit(p, HighScoreSubmit{PlayerName: tt.submitted, Token: "abc123"})
+
+			accepted, refused := highScoreReplies(t, p)
+			if (accepted == 1) != tt.wantSaved || accepted+refused != 1 {
+				t.Errorf("told %d accepted and %d refused, want saved: %v", accepted, refused, tt.wantSaved)
+			}
+			if scores, _ := board.Top(10); (len(scores) == 1) != tt.wantSaved {
+				t.Errorf("leaderboard holds %v, want saved: %v", scores, tt.wantSaved)
+			}
+			if (p.name != "") != tt.wantSaved {
+				t.Errorf("player now named %q, want saved: %v", p.name, tt.wantSaved)
+			}
+		})
+	}
+}
+
+func TestBroadcastPlayerCount(t *testing.T) {
+	savedQueue, savedLobbies, savedTotal := queue, lobbies, totalPlayers
+	defer func() { queue, lobbies, totalPlayers = savedQueue, savedLobbies, savedTotal }()
+
+	waiting := queued("waiting", 1500, 0)
+	l, p, other := seatedPair()
+	other.binary = true
+	queue, lobbies, totalPlayers = []*queueEntry{waiting}, []*Lobby{l}, 3
+
+	broadcastPlayerCount()
+	for name, pl := range map[string]*Player{"queued": waiting.player, "text": p, "binary": other} {
+		if len(pl.send) != 1 {
+			t.Errorf("%s player got %d messages, want 1", name, len(pl.send))
+			continue
+		}
+		f := <-pl.send
+		msg, err := decodeFrame(f.kind, f.data)
+		if err != nil {
+			t.Fatalf("%s player: %v", name, err)
+		}
+		if msg != (PlayerCount{Count: 3}) {
+			t.Errorf("%s player got %+v, want 3 online", name, msg)
+		}
+	}
+}
+
+// slowRatings is a rating store that takes a while to save and remembers
+// every save in order.
+type slowRatings struct {
+	memoryRatings
+	mu    sync.Mutex
+	saved []int
+}
+
+func (s *slowRatings) Set(name string, rating int) error {
+	time.Sleep(5 * time.Millisecond)
+	s.mu.Lock()
+	s.saved = append(s.saved, rating)
+	s.mu.Unlock()
+	return s.memoryRatings.Set(name, rating)
+}
+
+func TestSaveRatingNewestWins(t *testing.T) {
+	saved := ratings
+	defer func() { ratings = saved }()
+	store := &slowRatings{}
+	ratings = store
+
+	for r := 1501; r <= 1520; r++ {
+		saveRating("alice", r)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		pendingRatingsMu.Lock()
+		_, saving := pendingRatings["alice"]
+		pendingRatingsMu.Unlock()
+		if !saving {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ratings never finished saving")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if got, _ := store.Get("alice"); got != 1520 {
+		t.Errorf("saved rating = %d, want the newest, 1520", got)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for i := 1; i < len(store.saved); i++ {
+		if store.saved[i] < store.saved[i-1] {
+			t.Errorf("saved %v: an older rating landed after a newer one", store.saved)
+			break
+		}
+	}
+}
+
+// fightingPair seats two players mid-round: the attacker facing right
+// with the target within sword reach.
+func fightingPair() (*Lobby, *Player, *Player) {
+	l, attacker, target := seatedPair()
+	l.BestOf = 1
+	l.StartTime = time.Now().Add(-5 * time.Second)
+	attacker.State = RemoteState{X: 20, Y: 10, HP: 100, Facing: 'd', Player1: true}
+	target.State = RemoteState{X: 23, Y: 10, HP: 100, Facing: 'a'}
+	// Rounds that end are recorded in the background
+	if history == nil {
+		history = &memoryHistory{}
+	}
+	return l, attacker, target
+}
+
+// sentResults returns the round results queued for p.
+func sentResults(t *testing.T, p *Player) []MatchResult {
+	t.Helper()
+	var results []MatchResult
+	for len(p.send) > 0 {
+		f := <-p.send
+		msg, err := decodeFrame(f.kind, f.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r, ok := msg.(MatchResult); ok {
+			results = append(results, r)
+		}
+	}
+	return results
+}
+
+func TestResolveAttack(t *testing.T) {
+	tests := []struct {
+		name         string
+		setup        func(l *Lobby, attacker, target *Player)
+		wantAccepted bool
+		wantHP       int
+		wantEnded    bool
+	}{
+		{"hit", func(l *Lobby, a, tg *Player) {}, true, 100 - attackDamage, false},
+		{"out of reach", func(l *Lobby, a, tg *Player) { tg.State.X = 40 }, true, 100, false},
+		{"facing away", func(l *Lobby, a, tg *Player) { a.State.Facing = 'a' }, true, 100, false},
+		{"on cooldown", func(l *Lobby, a, tg *Player) {
+			a.lastAttack = time.Now().Add(-attackCooldown / 3)
+		}, false, 100, false},
+		{"cooldown with jitter slack", func(l *Lobby, a, tg *Player) {
+			a.lastAttack = time.Now().Add(-(attackCooldown - cooldownSlack + 10*time.Millisecond))
+		}, true, 100 - attackDamage, false},
+		{"target invulnerable", func(l *Lobby, a, tg *Player) {
+			tg.lastHit = time.Now().Add(-hitInvulnerability / 3)
+		}, true, 100, false},
+		{"target invulnerability over", func(l *Lobby, a, tg *Player) {
+			tg.lastHit = time.Now().Add(-hitInvulnerability)
+		}, true, 100 - attackDamage, false},
+		{"target's seat held", func(l *Lobby, a, tg *Player) { tg.away = true }, true, 100, false},
+		{"round already over", func(l *Lobby, a, tg *Player) { l.MatchEnded = true }, true, 100, true},
+		{"round not started", func(l *Lobby, a, tg *Player) { l.StartTime = time.Time{} }, true, 100, false},
+		{"HP floors at zero", func(l *Lobby, a, tg *Player) { tg.State.HP = attackDamage / 2 }, true, 0, true},
+		{"exact knockout", func(l *Lobby, a, tg *Player) { tg.State.HP = attackDamage }, true, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, attacker, target := fightingPair()
+			tt.setup(l, attacker, target)
+			accepted := resolveAttack(l, attacker)
+			if accepted != tt.wantAccepted {
+				t.Errorf("accepted = %v, want %v", accepted, tt.wantAccepted)
+			}
+			if target.State.HP != tt.wantHP {
+				t.Errorf("target HP = %d, want %d", target.State.HP, tt.wantHP)
+			}
+			if attacker.State.HP != 100 {
+				t.Errorf("attacker HP = %d, want it untouched", attacker.State.HP)
+			}
+			if l.MatchEnded != tt.wantEnded {
+				t.Errorf("round ended = %v, want %v", l.MatchEnded, tt.wantEnded)
+			}
+		})
+	}
+}
+
+func TestKnockoutEndsRound(t *testing.T) {
+	tests := []struct {
+		name       string
+		bestOf     int
+		botLoser   bool
+		wantSeries bool
+		wantToken  bool
+	}{
+		{"single fight", 1, false, true, true},
+		{"first round of three", 3, false, false, false},
+		{"against a bot", 1, true, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, winner, loser := fightingPair()
+			l.BestOf = tt.bestOf
+			l.Round = 1
+			loser.bot = tt.botLoser
+			loser.State.HP = attackDamage
+
+			resolveAttack(l, winner)
+			if !l.MatchEnded || l.SeriesOver != tt.wantSeries {
+				t.Fatalf("ended = %v, series over = %v; want true, %v", l.MatchEnded, l.SeriesOver, tt.wantSeries)
+			}
+			if l.RoundWins != [2]int{1, 0} {
+				t.Errorf("round wins = %v, want [1 0]", l.RoundWins)
+			}
+
+			if (winner.scoreToken != "") != tt.wantToken {
+				t.Errorf("winner holds token %q, want one: %v", winner.scoreToken, tt.wantToken)
+			}
+			if tt.wantToken && (winner.scoreDurationMs < 5000 || winner.scoreDurationMs > 6000) {
+				t.Errorf("token good for %dms, want the server's ~5000ms", winner.scoreDurationMs)
+			}
+			if loser.scoreToken != "" {
+				t.Errorf("loser was issued token %q", loser.scoreToken)
+			}
+
+			won, lost := sentResults(t, winner), sentResults(t, loser)
+			if len(won) != 1 || len(lost) != 1 {
+				t.Fatalf("sent %d results to the winner and %d to the loser, want 1 each", len(won), len(lost))
+			}
+			if !won[0].Won || lost[0].Won {
+				t.Errorf("winner told won=%v, loser told won=%v", won[0].Won, lost[0].Won)
+			}
+			if won[0].Token != winner.scoreToken {
+				t.Errorf("winner told token %q, server holds %q", won[0].Token, winner.scoreToken)
+			}
+			if lost[0].Token != "" {
+				t.Errorf("loser told token %q", lost[0].Token)
+			}
+		})
+	}
+}
+
+// serverConn returns the server's end of a test websocket, and the
+// client's end.
+func serverConn(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	client := dialTest(t, func(c *websocket.Conn) { conns <- c })
+	server := <-conns
+	t.Cleanup(func() { server.Close() })
+	return server, client
+}
+
+func TestSlowPlayerDropped(t *testing.T) {
+	slowConn, slowClient := serverConn(t)
+	fastConn, fastClient := serverConn(t)
+
+	// The slow player's writer is stuck, so nothing leaves its queue
+	slow := &Player{Conn: slowConn, send: make(chan frame, playerQueueSize), done: make(chan struct{})}
+	fast := newPlayer(fastConn)
+	defer fast.close()
+
+	for i := 0; i < playerQueueSize; i++ {
+		slow.sendMessage(PlayerCount{Count: i})
+		fast.sendMessage(PlayerCount{Count: i})
+	}
+	select {
+	case <-slow.done:
+		t.Fatal("slow player dropped before their queue was full")
+	default:
+	}
+	slow.sendMessage(PlayerCount{Count: playerQueueSize})
+
+	select {
+	case <-slow.done:
+	default:
+		t.Fatal("slow player with a full queue wasn't dropped")
+	}
+	if _, _, err := slowClient.ReadMessage(); err == nil {
+		t.Error("slow player's connection is still open")
+	}
+
+	select {
+	case <-fast.done:
+		t.Fatal("fast player was dropped along with the slow one")
+	default:
+	}
+	for i := 0; i < playerQueueSize; i++ {
+		msg, err := readMessage(fastClient)
+		if err != nil {
+			t.Fatalf("fast player's message %d: %v", i, err)
+		}
+		if msg != (PlayerCount{Count: i}) {
+			t.Fatalf("fast player's message %d = %+v", i, msg)
+		}
+	}
+}
+
+func TestUnresponsivePeerDropped(t *testing.T) {
+	savedPing, savedPong, savedGrace := pingPeriod, pongWait, reconnectGrace
+	defer func() { pingPeriod, pongWait, reconnectGrace = savedPing, savedPong, savedGrace }()
+	pingPeriod, pongWait, reconnectGrace = 20*time.Millisecond, 100*time.Millisecond, 200*time.Millisecond
+
+	l, dead, survivor := heldPair(t)
+	// Connected, with a hold to spare
+	dead.away, dead.holds = false, 0
+	deadConn, _ := serverConn(t)
+	survivorConn, survivorClient := serverConn(t)
+	l.mu.Lock()
+	dead.attach(deadConn)
+	survivor.attach(survivorConn)
+	l.mu.Unlock()
+	start := time.Now()
+	go handlePlayer(dead)
+	go handlePlayer(survivor)
+
+	// The dead peer's client never reads, so it never answers a ping;
+	// reading answers the survivor's
+	var held time.Duration
+	for {
+		msg, err := readMessage(survivorClient)
+		if err != nil {
+			t.Fatalf("survivor lost their connection: %v", err)
+		}
+		if status, ok := msg.(OpponentStatus); ok && status.Reconnecting {
+			held = time.Since(start)
+			continue
+		}
+		r, ok := msg.(MatchResult)
+		if !ok {
+			continue
+		}
+		if held == 0 {
+			t.Fatalf("survivor was sent %+v before hearing the opponent's seat was held", r)
+		}
+		if !r.Won || !r.Forfeit || !r.SeriesOver {
+			t.Errorf("survivor was sent %+v, want a forfeit win", r)
+		}
+		break
+	}
+	if held < pongWait {
+		t.Errorf("silent peer dropped after %v, before pongWait", held)
+	}
+	if gone := time.Since(start); gone < pongWait+reconnectGrace {
+		t.Errorf("silent peer forfeited after %v, before their seat's grace ran out", gone)
+	}
+
+	hangUp(t, survivorClient)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// readReplay loads a replay file. A file cut short, say by the server
+// stopping mid-series, still plays up to where it ends.
+func readReplay(path string) (ReplayHeader, []ReplayEvent, error) {
+	var header ReplayHeader
+	file, err := os.Open(path)
+	if err != nil {
+		return header, nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return header, nil, fmt.Errorf("%s is not a replay: %w", path, err)
+	}
+	dec := json.NewDecoder(gz)
+	if err := dec.Decode(&header); err != nil || header.Format != replayFormat {
+		return header, nil, fmt.Errorf("%s is not a replay", path)
+	}
+	if header.Version > replayVersion {
+		return header, nil, fmt.Errorf("%s is a version %d replay; this duel reads up to version %d, so upgrade to watch it", path, header.Version, replayVersion)
+	}
+
+	var events []ReplayEvent
+	for {
+		var ev ReplayEvent
+		err := dec.Decode(&ev)
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return header, events, fmt.Errorf("reading %s: %w", path, err)
+		}
+		events = append(events, ev)
+	}
+	return header, events, nil
+}
+
+// Playback controls.
+var replaySpeeds = []float64{0.5, 1, 2}
+
+const (
+	replaySeekStep   = time.Second
+	replayBannerTime = 2 * time.Second
+)
+
+// replayKnight is one duelist at the current point in a replay. Times are
+// in replay milliseconds.
+type replayKnight struct {
+	state    RemoteState
+	seen     bool
+	attackAt int64
+	hitAt    int64
+}
+
+// replayPlayer steps through a replay's events at its own pace.
+type replayPlayer struct {
+	g      *Game
+	header ReplayHeader
+	events []ReplayEvent
+	length int64 // ms, the last event's time
+
+	pos     int64 // ms into the replay
+	next    int   // first event not yet applied
+	knights [2]replayKnight
+	result  *MatchResult // last round result, left knight's view
+	resultT int64
+
+	paused    bool
+	speed     int  // index into replaySpeeds
+	exporting bool // drawing for a cast, so no controls to show
+}
+
+// reset rewinds to the start, before any event.
+func (rp *replayPlayer) reset() {
+	rp.pos, rp.next = 0, 0
+	rp.result = nil
+	// Long enough ago that no slash or hit flash shows
+	const never = -1 << 40
+	rp.knights[0] = replayKnight{attackAt: never, hitAt: never}
+	rp.knights[1] = replayKnight{attackAt: never, hitAt: never}
+	rp.knights[0].state.Facing = 'd'
+	rp.knights[1].state.Facing = 'a'
+}
+
+// seek moves to t, clamped to the replay. Seeking back replays from the
+// start, which is quick for a fight's worth of events.
+func (rp *replayPlayer) seek(t int64) {
+	t = max(0, min(t, rp.length))
+	if t < rp.pos {
+		rp.reset()
+	}
+	for rp.next < len(rp.events) && rp.events[rp.next].T <= t {
+		rp.apply(rp.events[rp.next])
+		rp.next++
+	}
+	rp.pos = t
+}
+
+func (rp *replayPlayer) apply(ev ReplayEvent) {
+	if st := ev.State; st != nil {
+		i := 1
+		if st.Player1 {
+			i = 0
+		}
+		k := &rp.knights[i]
+		if k.seen && st.HP < k.state.HP {
+			k.hitAt = ev.T
+		}
+		if st.Attack {
+			k.attackAt = ev.T
+		}
+		if st.Facing == 0 {
+			st.Facing = k.state.Facing
+		}
+		k.state = *st
+		k.seen = true
+	}
+	if ev.Result != nil {
+		rp.result = ev.Result
+		rp.resultT = ev.T
+	}
+}
+
+// PlayReplay plays a replay file offline.
+func PlayReplay(path string) {
+	header, events, err := readReplay(path)
+	if err != nil {
+		fmt.Println("Can't play replay:", err)
+		return
+	}
+	if len(events) == 0 {
+		fmt.Println("Replay is empty")
+		return
+	}
+
+	g := &Game{screen: newScreen()}
+	defer g.screen.Fini()
+
+	rp := &replayPlayer{g: g, header: header, events: events, speed: 1}
+	rp.length = events[len(events)-1].T
+	rp.reset()
+	rp.seek(0)
+
+	inputChan := make(chan *tcell.EventKey, 10)
+	go func() {
+		for {
+			ev := g.screen.PollEvent()
+			if ev == nil {
+				return
+			}
+			if key, ok := ev.(*tcell.EventKey); ok {
+				inputChan <- key
+			}
+		}
+	}()
+
+	frame := tickRate.Milliseconds()
+	ticker := time.NewTicker(tickRate)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-inputChan:
+			switch ev.Key() {
+			case tcell.KeyEscape, tcell.KeyCtrlC:
+				return
+			case tcell.KeyLeft:
+				rp.seek(rp.pos - replaySeekStep.Milliseconds())
+			case tcell.KeyRight:
+				rp.seek(rp.pos + replaySeekStep.Milliseconds())
+			case tcell.KeyHome:
+				rp.seek(0)
+			case tcell.KeyRune:
+				switch ev.Rune() {
+				case 'q', 'Q':
+					return
+				case ' ':
+					if rp.pos >= rp.length {
+						rp.seek(0)
+					}
+					rp.paused = !rp.paused
+				case '.':
+					// Frame stepping pauses so the step stays put
+					rp.paused = true
+					rp.seek(rp.pos + frame)
+				case ',':
+					rp.paused = true
+					rp.seek(rp.pos - frame)
+				case '-':
+					rp.speed = max(rp.speed-1, 0)
+				case '+', '=':
+					rp.speed = min(rp.speed+1, len(replaySpeeds)-1)
+				}
+			}
+			rp.draw()
+
+		case <-ticker.C:
+			if !rp.paused {
+				rp.seek(rp.pos + int64(float64(frame)*replaySpeeds[rp.speed]))
+				if rp.pos >= rp.length {
+					rp.paused = true
+				}
+			}
+			rp.draw()
+		}
+	}
+}
+
+func (rp *replayPlayer) draw() {
+	g := rp.g
+	g.screen.Clear()
+	g.drawArena()
+
+	slashDuration := int64(150)
+	flashDuration := int64(200)
+	centerX := (arenaLeft + arenaRight) / 2
+
+	for i := range rp.knights {
+		k := &rp.knights[i]
+		if !k.seen {
+			continue
+		}
+		style := tcell.StyleDefault.Foreground(knightColors[i])
+		if rp.pos-k.hitAt < flashDuration {
+			style = style.Foreground(tcell.ColorWhite)
+		}
+		g.drawCharacter(k.state.X, k.state.Y, k.state.Facing, style)
+	}
+	// Sword slashes on top of both knights
+	for i := range rp.knights {
+		k := &rp.knights[i]
+		if k.seen && rp.pos-k.attackAt < slashDuration {
+			g.drawSword(k.state.X, k.state.Y, k.state.Facing, tcell.StyleDefault.Foreground(knightColors[i]))
+		}
+	}
+
+	// HP for both sides, like the spectator HUD
+	for i := range rp.knights {
+		k := &rp.knights[i]
+		name := knightNames[i]
+		if rp.header.Players[i] != "" {
+			name = fmt.Sprintf("%s (%s)", knightNames[i], rp.header.Players[i])
+		}
+		line := fmt.Sprintf("%s: %d HP", name, k.state.HP)
+		for j, r := range line {
+			g.screen.SetContent(centerX-len(line)/2+j, i, r, nil, tcell.StyleDefault.Foreground(knightColors[i]))
+		}
+	}
+
+	header := "Replay"
+	if rp.header.Source == "server" {
+		header = fmt.Sprintf("Replay of lobby %d", rp.header.LobbyID)
+	}
+	for i, r := range header {
+		g.screen.SetContent(arenaLeft+5+i, 0, r, nil, tcell.StyleDefault.Foreground(tcell.ColorDarkGray))
+	}
+	// Below the HP lines, like the spectator's series score
+	if r := rp.result; r != nil && r.BestOf > 1 {
+		series := fmt.Sprintf("Bo%d  Round %d  %d-%d", r.BestOf, r.Round, r.Wins, r.EnemyWins)
+		for i, ch := range series {
+			g.screen.SetContent(arenaLeft+5+i, arenaTop-1, ch, nil, tcell.StyleDefault.Foreground(tcell.ColorDarkGray))
+		}
+	}
+
+	if r := rp.result; r != nil && rp.pos-rp.resultT < replayBannerTime.Milliseconds() {
+		winner := 1
+		if r.Won {
+			winner = 0
+		}
+		banner := fmt.Sprintf("%s WINS", knightNames[winner])
+		for i, ch := range banner {
+			g.screen.SetContent(centerX-len(banner)/2+i, (arenaTop+arenaBottom)/2-4, ch, nil, tcell.StyleDefault.Foreground(knightColors[winner]).Bold(true))
+		}
+	}
+
+	if rp.exporting {
+		g.screen.Show()
+		return
+	}
+	_, h := g.screen.Size()
+	state := "▶"
+	if rp.paused {
+		state = "⏸"
+	}
+	status := fmt.Sprintf("%s %5.1fs / %.1fs  %gx   Space pause  ←/→ seek 1s  ,/. step  -/+ speed  Q quit",
+		state, float64(rp.pos)/1000, float64(rp.length)/1000, replaySpeeds[rp.speed])
+	col := 0
+	for _, r := range status {
+		g.screen.SetContent(col, h-1, r, nil, tcell.StyleDefault.Foreground(tcell.ColorDarkGray))
+		col++
+	}
+	g.screen.Show()
+}
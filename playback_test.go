@@ -0,0 +1,103 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// testReplayEvents is a short fight: the right knight walks in, swings and
+// lands one hit, and then the round ends in the left knight's favour.
+var testReplayEvents = []ReplayEvent{
+	{T: 0, State: &RemoteState{X: 10, Y: 12, HP: 100, Facing: 'd', Player1: true}},
+	{T: 0, State: &RemoteState{X: 65, Y: 12, HP: 100, Facing: 'a'}},
+	{T: 1000, State: &RemoteState{X: 14, Y: 12, HP: 100, Facing: 'a'}},
+	{T: 1500, State: &RemoteState{X: 14, Y: 12, HP: 100, Attack: true}},
+	{T: 1500, State: &RemoteState{X: 10, Y: 12, HP: 90, Facing: 'd', Player1: true}},
+	{T: 3000, Result: &MatchResult{Won: true, Round: 1, BestOf: 1, Wins: 1, SeriesOver: true}},
+}
+
+// loadTestReplay writes testReplayEvents to a file and reads it back into
+// a player rewound to the start.
+func loadTestReplay(t *testing.T) *replayPlayer {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.replay")
+	writeReplay(t, path, ReplayHeader{Source: "server", BestOf: 1}, testReplayEvents)
+	header, events, err := readReplay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := &replayPlayer{header: header, events: events, speed: 1}
+	rp.length = events[len(events)-1].T
+	rp.reset()
+	return rp
+}
+
+func TestReplaySeek(t *testing.T) {
+	tests := []struct {
+		name       string
+		seeks      []int64
+		wantPos    int64
+		wantRightX int
+		wantLeftHP int
+		wantResult bool
+	}{
+		{"start", []int64{0}, 0, 65, 100, false},
+		{"mid-walk", []int64{999}, 999, 65, 100, false},
+		{"after the walk", []int64{1000}, 1000, 14, 100, false},
+		{"after the hit", []int64{2000}, 2000, 14, 90, false},
+		{"end", []int64{3000}, 3000, 14, 90, true},
+		{"past the end", []int64{9000}, 3000, 14, 90, true},
+		{"before the start", []int64{-500}, 0, 65, 100, false},
+		{"back before the hit", []int64{3000, 1200}, 1200, 14, 100, false},
+		{"back to the start", []int64{2000, 0}, 0, 65, 100, false},
+		{"stepping", []int64{970, 1000, 1030}, 1030, 14, 100, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := loadTestReplay(t)
+			for _, to := range tt.seeks {
+				rp.seek(to)
+			}
+			if rp.pos != tt.wantPos {
+				t.Errorf("at %dms, want %dms", rp.pos, tt.wantPos)
+			}
+			left, right := rp.knights[0], rp.knights[1]
+			if !left.seen || !right.seen {
+				t.Fatal("a knight hasn't been seen at the start of the fight")
+			}
+			if right.state.X != tt.wantRightX {
+				t.Errorf("right knight at x=%d, want %d", right.state.X, tt.wantRightX)
+			}
+			if left.state.HP != tt.wantLeftHP {
+				t.Errorf("left knight at %d HP, want %d", left.state.HP, tt.wantLeftHP)
+			}
+			if (rp.result != nil) != tt.wantResult {
+				t.Errorf("result shown = %v, want %v", rp.result != nil, tt.wantResult)
+			}
+		})
+	}
+}
+
+func TestReplayApply(t *testing.T) {
+	rp := loadTestReplay(t)
+	rp.seek(1500)
+	left, right := rp.knights[0], rp.knights[1]
+	if left.hitAt != 1500 {
+		t.Errorf("left knight's hit flash at %dms, want 1500", left.hitAt)
+	}
+	if right.attackAt != 1500 {
+		t.Errorf("right knight's slash at %dms, want 1500", right.attackAt)
+	}
+	if right.state.Facing != 'a' {
+		t.Errorf("right knight facing %c after a state without one, want it kept as a", right.state.Facing)
+	}
+	if right.hitAt == 1500 {
+		t.Error("swinging flashed the right knight as hit")
+	}
+
+	// Rewinding clears what hasn't happened yet
+	rp.seek(500)
+	if rp.knights[0].hitAt >= 0 || rp.knights[1].attackAt >= 0 {
+		t.Errorf("rewound to 500ms but still flashing: hit %dms, slash %dms", rp.knights[0].hitAt, rp.knights[1].attackAt)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// botLevel tunes how well the practice bot fights.
+type botLevel struct {
+	moveEvery int           // ticks per step; higher is slower
+	reaction  time.Duration // how far behind the bot's view of you lags
+	swingOdds float64       // chance it takes a swing that would land
+	spacing   int           // horizontal distance it tries to hold, 0 to crowd in; 3 is sword's length
+	retreat   int           // ticks it backs off after swinging
+}
+
+var botLevels = map[string]botLevel{
+	"easy":   {moveEvery: 3, reaction: 400 * time.Millisecond, swingOdds: 0.35},
+	"normal": {moveEvery: 2, reaction: 200 * time.Millisecond, swingOdds: 0.7, spacing: 3, retreat: 4},
+	"hard":   {moveEvery: 1, reaction: 60 * time.Millisecond, swingOdds: 0.95, spacing: 3, retreat: 6},
+}
+
+// fighter is one side of an offline fight.
+type fighter struct {
+	x, y       int
+	hp         int
+	facing     rune
+	lastAttack time.Time
+	lastHit    time.Time
+}
+
+func (f *fighter) spawn(x int, facing rune) {
+	*f = fighter{x: x, y: 12, hp: 100, facing: facing}
+}
+
+// strike applies an attack from a to b using the server's rules, reporting
+// whether the swing was allowed and whether it landed.
+func strike(a, b *fighter, now time.Time) (swung, hit bool) {
+	if now.Sub(a.lastAttack) < attackCooldown-cooldownSlack {
+		return false, false
+	}
+	a.lastAttack = now
+	if now.Sub(b.lastHit) < hitInvulnerability || !canHit(a.x, a.y, a.facing, b.x, b.y) {
+		return true, false
+	}
+	b.hp = max(b.hp-attackDamage, 0)
+	b.lastHit = now
+	return true, true
+}
+
+// sighting is where the bot saw the player, for its reaction delay.
+type sighting struct {
+	at   time.Time
+	x, y int
+}
+
+// botBrain decides a bot's moves. It's shared by offline practice and the
+// server's bot fill, which resolve the swings it takes in their own ways.
+type botBrain struct {
+	level     botLevel
+	seen      []sighting // recent player positions, oldest first
+	tick      int
+	retreatAt int // tick the current retreat ends
+}
+
+// practiceMatch stands in for the server during `duel practice`. It speaks
+// the same messages over channels, so Game.Run plays exactly as online.
+type practiceMatch struct {
+	brain  botBrain
+	player fighter
+	bot    fighter
+	start  time.Time
+	over   bool
+
+	in      chan interface{} // from the game, like a websocket read
+	netChan chan RemoteState
+	msgChan chan interface{}
+	done    chan struct{}
+}
+
+// StartPractice fights an offline bot at the given difficulty.
+func StartPractice(level string) {
+	lvl, ok := botLevels[level]
+	if !ok {
+		fmt.Println("Difficulty must be easy, normal or hard")
+		return
+	}
+	m := &practiceMatch{
+		brain:   botBrain{level: lvl},
+		in:      make(chan interface{}, 64),
+		netChan: make(chan RemoteState, 10),
+		msgChan: make(chan interface{}, 10),
+		done:    make(chan struct{}),
+	}
+	go m.run()
+
+	game := NewGame(true)
+	game.Run(m.netChan, m.msgChan, func(v interface{}) {
+		select {
+		case m.in <- v:
+		default:
+		}
+	})
+	close(m.done)
+}
+
+// send delivers a message to the game unless it has quit.
+func (m *practiceMatch) send(v interface{}) {
+	select {
+	case m.msgChan <- v:
+	case <-m.done:
+	}
+}
+
+func (m *practiceMatch) startRound() {
+	m.player.spawn(10, 'd')
+	m.bot.spawn(65, 'a')
+	m.brain.seen = nil
+	m.start = time.Now()
+	m.over = false
+	m.send(RoundStart{
+		Player1: true,
+		X:       m.player.x,
+		Y:       m.player.y,
+		HP:      m.player.hp,
+		EnemyX:  m.bot.x,
+		EnemyY:  m.bot.y,
+		EnemyHP: m.bot.hp,
+		Round:   1,
+		BestOf:  1,
+	})
+}
+
+func (m *practiceMatch) run() {
+	ticker := time.NewTicker(tickRate)
+	defer ticker.Stop()
+	m.startRound()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case msg := <-m.in:
+			if !m.handle(msg, time.Now()) {
+				return
+			}
+		case now := <-ticker.C:
+			m.tick(now)
+		}
+	}
+}
+
+// handle acts on a message from the game, reporting false once the player
+// has turned down a rematch.
+func (m *practiceMatch) handle(msg interface{}, now time.Time) bool {
+	switch msg := msg.(type) {
+	case RemoteState:
+		m.player.x, m.player.y = clampToArena(msg.X, msg.Y)
+		if msg.Facing != 0 {
+			m.player.facing = msg.Facing
+		}
+		m.send(StateAck{Seq: msg.Seq, X: m.player.x, Y: m.player.y})
+		if msg.Attack && !m.over {
+			if _, hit := strike(&m.player, &m.bot, now); hit {
+				m.landed(&m.bot)
+			}
+		}
+	case RematchRequest:
+		if !msg.Accept {
+			return false
+		}
+		m.startRound()
+	}
+	return true
+}
+
+// tick runs the bot for one tick and shows the game where it is now.
+func (m *practiceMatch) tick(now time.Time) {
+	if m.over {
+		return
+	}
+	attack := m.brain.decide(now, &m.bot, m.player.x, m.player.y)
+	if attack {
+		if _, hit := strike(&m.bot, &m.player, now); hit {
+			m.landed(&m.player)
+		}
+	}
+	st := RemoteState{X: m.bot.x, Y: m.bot.y, HP: m.bot.hp, Attack: attack, Facing: m.bot.facing}
+	select {
+	case m.netChan <- st:
+	default:
+	}
+}
+
+// landed reports a hit on target to the game and ends the round on a
+// knockout.
+func (m *practiceMatch) landed(target *fighter) {
+	m.send(HealthUpdate{HP: m.player.hp, EnemyHP: m.bot.hp})
+	if target.hp > 0 {
+		return
+	}
+	m.over = true
+	won := target == &m.bot
+	result := MatchResult{
+		Won:        won,
+		DurationMs: time.Since(m.start).Milliseconds(),
+		Round:      1,
+		BestOf:     1,
+		SeriesOver: true,
+	}
+	if won {
+		result.Wins = 1
+	} else {
+		result.EnemyWins = 1
+	}
+	m.send(result)
+}
+
+// decide runs bot for one tick against a player at (x, y): watch, then
+// swing, back off or close in. It moves and turns bot itself but leaves a
+// swing, reported by returning true, for the caller to resolve.
+func (b *botBrain) decide(now time.Time, bot *fighter, x, y int) bool {
+	b.tick++
+	px, py := b.sighting(now, x, y)
+
+	// Turn towards the player along whichever axis is further apart
+	dx, dy := px-bot.x, py-bot.y
+	if abs(dx) >= abs(dy) {
+		bot.facing = 'd'
+		if dx < 0 {
+			bot.facing = 'a'
+		}
+	} else {
+		bot.facing = 's'
+		if dy < 0 {
+			bot.facing = 'w'
+		}
+	}
+
+	if canHit(bot.x, bot.y, bot.facing, px, py) && now.Sub(bot.lastAttack) >= attackCooldown {
+		if rand.Float64() >= b.level.swingOdds {
+			// Hesitate for a cooldown instead of rolling every tick
+			bot.lastAttack = now
+			return false
+		}
+		b.retreatAt = b.tick + b.level.retreat
+		return true
+	}
+
+	if b.tick%b.level.moveEvery != 0 {
+		return false
+	}
+	stepX, stepY := sign(dx), sign(dy)
+	switch {
+	case b.tick < b.retreatAt:
+		// Back off along the line of attack
+		stepX, stepY = -stepX, 0
+	case b.level.spacing > 0 && abs(dx) <= b.level.spacing && dy != 0:
+		// Line up for a sword's-length swing rather than closing in
+		stepX = 0
+	case b.level.spacing > 0 && abs(dx) <= b.level.spacing:
+		stepX = 0
+		if abs(dx) < b.level.spacing {
+			stepX = -sign(dx)
+		}
+	}
+	bot.x, bot.y = clampToArena(bot.x+stepX, bot.y+stepY)
+	return false
+}
+
+// sighting notes the player at (x, y) and returns where they were one
+// reaction time ago.
+func (b *botBrain) sighting(now time.Time, x, y int) (int, int) {
+	b.seen = append(b.seen, sighting{at: now, x: x, y: y})
+	i := 0
+	for i+1 < len(b.seen) && now.Sub(b.seen[i+1].at) >= b.level.reaction {
+		i++
+	}
+	b.seen = b.seen[i:]
+	return b.seen[0].x, b.seen[0].y
+}
+
+func sign(n int) int {
+	switch {
+	case n > 0:
+		return 1
+	case n < 0:
+		return -1
+	}
+	return 0
+}
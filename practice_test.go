@@ -0,0 +1,218 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBotDecide(t *testing.T) {
+	tests := []struct {
+		name       string
+		level      string
+		px, py     int // player, with the bot at (40, 12)
+		wantFacing rune
+		wantStepX  int // after moveEvery ticks
+		wantStepY  int
+	}{
+		{"easy closes in", "easy", 20, 12, 'a', -1, 0},
+		{"easy crowds in", "easy", 43, 12, 'd', 1, 0},
+		{"easy climbs", "easy", 40, 5, 'w', 0, -1},
+		{"normal closes in", "normal", 60, 14, 'd', 1, 1},
+		{"normal holds sword's length", "normal", 37, 12, 'a', 0, 0},
+		{"normal backs off to sword's length", "normal", 42, 12, 'd', -1, 0},
+		{"normal lines up", "normal", 43, 16, 's', 0, 1},
+		{"hard closes in", "hard", 40, 20, 's', 0, 1},
+		{"hard holds sword's length", "hard", 43, 12, 'd', 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lvl := botLevels[tt.level]
+			brain := botBrain{level: lvl}
+			bot := fighter{x: 40, y: 12, hp: 100, facing: 'a'}
+			// Fresh off a swing, so the bot can only move
+			now := time.Now()
+			bot.lastAttack = now
+
+			for i := 0; i < lvl.moveEvery; i++ {
+				if brain.decide(now, &bot, tt.px, tt.py) {
+					t.Fatal("bot swung during its cooldown")
+				}
+			}
+			if bot.facing != tt.wantFacing {
+				t.Errorf("facing %c, want %c", bot.facing, tt.wantFacing)
+			}
+			if dx, dy := bot.x-40, bot.y-12; dx != tt.wantStepX || dy != tt.wantStepY {
+				t.Errorf("stepped (%d, %d), want (%d, %d)", dx, dy, tt.wantStepX, tt.wantStepY)
+			}
+		})
+	}
+}
+
+func TestBotDecideSwings(t *testing.T) {
+	for name, lvl := range botLevels {
+		t.Run(name, func(t *testing.T) {
+			brain := botBrain{level: lvl}
+			bot := fighter{x: 40, y: 12, hp: 100, facing: 'd'}
+			now := time.Now()
+
+			// In reach and off cooldown the bot either swings, leaving it
+			// for the caller to resolve, or hesitates for a cooldown
+			swung := brain.decide(now, &bot, 43, 12)
+			if swung {
+				if bot.lastAttack == now {
+					t.Error("swing resolved by decide instead of its caller")
+				}
+				if brain.retreatAt != brain.tick+lvl.retreat {
+					t.Errorf("retreat ends at tick %d, want %d", brain.retreatAt, brain.tick+lvl.retreat)
+				}
+			} else if bot.lastAttack != now {
+				t.Error("bot neither swung nor waited out a cooldown")
+			}
+			if bot.x != 40 || bot.y != 12 {
+				t.Errorf("bot moved to (%d, %d) while deciding to swing", bot.x, bot.y)
+			}
+		})
+	}
+}
+
+func TestBotRetreats(t *testing.T) {
+	lvl := botLevels["hard"]
+	brain := botBrain{level: lvl, tick: 10, retreatAt: 10 + lvl.retreat}
+	bot := fighter{x: 40, y: 12, hp: 100, facing: 'd', lastAttack: time.Now()}
+	brain.decide(time.Now(), &bot, 42, 13)
+	if bot.x != 39 || bot.y != 12 {
+		t.Errorf("retreating bot moved to (%d, %d), want straight back to (39, 12)", bot.x, bot.y)
+	}
+}
+
+func TestBotReaction(t *testing.T) {
+	for name, lvl := range botLevels {
+		t.Run(name, func(t *testing.T) {
+			brain := botBrain{level: lvl}
+			start := time.Now()
+			brain.sighting(start, 10, 12)
+			if x, _ := brain.sighting(start.Add(lvl.reaction/2), 20, 12); x != 10 {
+				t.Errorf("bot saw x=%d before its reaction time, want the old 10", x)
+			}
+			if x, _ := brain.sighting(start.Add(lvl.reaction/2+lvl.reaction), 30, 12); x != 20 {
+				t.Errorf("bot saw x=%d a reaction time on, want 20", x)
+			}
+		})
+	}
+}
+
+// newTestPractice is a practice match against a bot that swings whenever
+// it can, with queues big enough to leave undrained.
+func newTestPractice() *practiceMatch {
+	m := &practiceMatch{
+		brain:   botBrain{level: botLevel{moveEvery: 1, swingOdds: 1}},
+		in:      make(chan interface{}, 64),
+		netChan: make(chan RemoteState, 64),
+		msgChan: make(chan interface{}, 64),
+		done:    make(chan struct{}),
+	}
+	m.startRound()
+	return m
+}
+
+// practiceMessages returns everything the match has sent the game.
+func practiceMessages(m *practiceMatch) []interface{} {
+	var msgs []interface{}
+	for len(m.msgChan) > 0 {
+		msgs = append(msgs, <-m.msgChan)
+	}
+	return msgs
+}
+
+func TestPracticeHit(t *testing.T) {
+	m := newTestPractice()
+	practiceMessages(m)
+	m.bot.x = 40
+
+	m.handle(RemoteState{Seq: 3, X: 37, Y: 12, Facing: 'd', Attack: true}, time.Now())
+	want := []interface{}{
+		StateAck{Seq: 3, X: 37, Y: 12},
+		HealthUpdate{HP: 100, EnemyHP: 100 - attackDamage},
+	}
+	if got := practiceMessages(m); !reflect.DeepEqual(got, want) {
+		t.Errorf("game was sent %+v, want %+v", got, want)
+	}
+
+	// The bot swings straight back, from where it stands
+	m.tick(time.Now())
+	if m.player.hp != 100-attackDamage {
+		t.Errorf("player at %d HP after the bot's swing, want %d", m.player.hp, 100-attackDamage)
+	}
+	if st := <-m.netChan; st.X != 40 || !st.Attack || st.HP != 100-attackDamage {
+		t.Errorf("bot shown as %+v, want swinging at x=40", st)
+	}
+}
+
+func TestPracticeKnockout(t *testing.T) {
+	tests := []struct {
+		name    string
+		ko      func(m *practiceMatch, now time.Time)
+		wantWon bool
+	}{
+		{"player wins", func(m *practiceMatch, now time.Time) {
+			m.bot.hp = attackDamage
+			m.handle(RemoteState{X: 37, Y: 12, Facing: 'd', Attack: true}, now)
+		}, true},
+		{"bot wins", func(m *practiceMatch, now time.Time) {
+			m.player.hp = attackDamage
+			m.tick(now)
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestPractice()
+			practiceMessages(m)
+			m.bot.x, m.player.x, m.player.facing = 40, 37, 'd'
+			now := time.Now()
+			tt.ko(m, now)
+
+			msgs := practiceMessages(m)
+			r, ok := msgs[len(msgs)-1].(MatchResult)
+			if !ok || r.Won != tt.wantWon || !r.SeriesOver || r.Wins+r.EnemyWins != 1 || (r.Wins == 1) != tt.wantWon {
+				t.Fatalf("game was sent %+v last, want the result", msgs[len(msgs)-1])
+			}
+			if !m.over {
+				t.Fatal("match went on after a knockout")
+			}
+
+			// Nothing moves on the result screen
+			for len(m.netChan) > 0 {
+				<-m.netChan
+			}
+			m.tick(now.Add(time.Second))
+			m.handle(RemoteState{X: 37, Y: 12, Facing: 'd', Attack: true}, now.Add(time.Second))
+			if len(m.netChan) != 0 || m.bot.x != 40 {
+				t.Error("bot kept fighting after the knockout")
+			}
+			for _, msg := range practiceMessages(m) {
+				if _, ok := msg.(StateAck); !ok {
+					t.Errorf("game was sent %+v after the knockout", msg)
+				}
+			}
+
+			// A rematch resets the arena
+			if !m.handle(RematchRequest{Accept: true}, now) {
+				t.Fatal("accepting a rematch ended the match")
+			}
+			if m.over || m.player.hp != 100 || m.bot.hp != 100 || m.player.x != 10 || m.bot.x != 65 {
+				t.Errorf("rematch started with player %+v, bot %+v", m.player, m.bot)
+			}
+			msgs = practiceMessages(m)
+			if len(msgs) != 1 {
+				t.Fatalf("rematch sent %+v, want a round start", msgs)
+			}
+			if rs, ok := msgs[0].(RoundStart); !ok || rs.HP != 100 || rs.EnemyHP != 100 || rs.X != 10 || rs.EnemyX != 65 {
+				t.Errorf("rematch sent %+v, want a fresh round", msgs[0])
+			}
+			if m.handle(RematchRequest{}, now) {
+				t.Error("declining a rematch didn't end the match")
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+// pendingMove is a state we've sent but the server hasn't acknowledged yet,
+// kept so its movement can be replayed on top of an authoritative position.
+type pendingMove struct {
+	seq    uint32
+	dx, dy int
+}
+
+// maxPendingMoves caps the replay buffer in case acks stop arriving.
+const maxPendingMoves = 64
+
+// sendState sends our predicted state under the next sequence number and
+// remembers how far we moved since the previous one.
+func (g *Game) sendState(sendMsg func(interface{}), attacking bool) {
+	g.seq++
+	g.pending = append(g.pending, pendingMove{
+		seq: g.seq,
+		dx:  g.PlayerX - g.sentX,
+		dy:  g.PlayerY - g.sentY,
+	})
+	if len(g.pending) > maxPendingMoves {
+		g.pending = g.pending[len(g.pending)-maxPendingMoves:]
+	}
+	g.sentX, g.sentY = g.PlayerX, g.PlayerY
+
+	st := RemoteState{
+		Seq:    g.seq,
+		X:      g.PlayerX,
+		Y:      g.PlayerY,
+		HP:     g.hp,
+		Attack: attacking,
+		Facing: g.facing,
+	}
+	sendMsg(st)
+
+	st.Player1 = g.isLeft
+	g.recorder.state(st)
+}
+
+// reconcile rebases our predicted position on the server's authoritative
+// one, replaying every move it hasn't processed yet. When the server
+// accepted everything this lands exactly where we already are.
+func (g *Game) reconcile(ack StateAck) {
+	i := 0
+	for i < len(g.pending) && g.pending[i].seq <= ack.Seq {
+		i++
+	}
+	g.pending = g.pending[i:]
+
+	x, y := ack.X, ack.Y
+	for _, m := range g.pending {
+		x, y = clampToArena(x+m.dx, y+m.dy)
+	}
+	g.PlayerX, g.PlayerY = x, y
+	g.sentX, g.sentY = x, y
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+// predicted returns a game that has sent one state per step, moving by
+// each step in turn from (x, y).
+func predicted(x, y int, steps [][2]int) *Game {
+	g := &Game{PlayerX: x, PlayerY: y, sentX: x, sentY: y}
+	for _, s := range steps {
+		g.PlayerX += s[0]
+		g.PlayerY += s[1]
+		g.sendState(func(interface{}) {}, false)
+	}
+	return g
+}
+
+func TestReconcile(t *testing.T) {
+	right3 := [][2]int{{1, 0}, {1, 0}, {1, 0}}
+	tests := []struct {
+		name         string
+		fromX, fromY int
+		steps        [][2]int
+		ack          StateAck
+		wantX, wantY int
+		wantPending  int
+	}{
+		{"all accepted", 20, 10, right3, StateAck{Seq: 3, X: 23, Y: 10}, 23, 10, 0},
+		{"first accepted, rest replayed", 20, 10, right3, StateAck{Seq: 1, X: 21, Y: 10}, 23, 10, 2},
+		{"first rejected, rest replayed", 20, 10, right3, StateAck{Seq: 1, X: 20, Y: 10}, 22, 10, 2},
+		{"server corrected", 20, 10, right3, StateAck{Seq: 2, X: 22, Y: 12}, 23, 12, 1},
+		{"stale ack", 20, 10, right3, StateAck{Seq: 0, X: 20, Y: 10}, 23, 10, 3},
+		{"ack ahead of us", 20, 10, right3, StateAck{Seq: 9, X: 30, Y: 10}, 30, 10, 0},
+		{"diagonal replay", 20, 10, [][2]int{{1, 1}, {1, 1}}, StateAck{Seq: 1, X: 21, Y: 11}, 22, 12, 1},
+		{"replay clamped to arena", arenaRight - 4, 10, right3, StateAck{Seq: 1, X: arenaRight - 2, Y: 10}, arenaRight - 2, 10, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := predicted(tt.fromX, tt.fromY, tt.steps)
+			g.reconcile(tt.ack)
+			if g.PlayerX != tt.wantX || g.PlayerY != tt.wantY {
+				t.Errorf("reconciled to (%d, %d), want (%d, %d)", g.PlayerX, g.PlayerY, tt.wantX, tt.wantY)
+			}
+			if len(g.pending) != tt.wantPending {
+				t.Errorf("%d moves pending, want %d", len(g.pending), tt.wantPending)
+			}
+			if g.sentX != g.PlayerX || g.sentY != g.PlayerY {
+				t.Errorf("next move measured from (%d, %d), want (%d, %d)", g.sentX, g.sentY, g.PlayerX, g.PlayerY)
+			}
+		})
+	}
+}
+
+func TestSendStatePendingCapped(t *testing.T) {
+	steps := make([][2]int, maxPendingMoves+10)
+	g := predicted(20, 10, steps)
+	if len(g.pending) != maxPendingMoves {
+		t.Fatalf("%d moves pending, want %d", len(g.pending), maxPendingMoves)
+	}
+	if g.pending[0].seq != 11 {
+		t.Errorf("oldest pending seq = %d, want 11", g.pending[0].seq)
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// protocolVersion is the websocket protocol this build speaks. Bump it
+// whenever a message changes in a way the other side can't read. Version 1
+// was the bare JSON spoken before envelopes.
+const protocolVersion = 2
+
+// Envelope wraps every websocket message: which message Data holds, and
+// the protocol version of whoever sent it. Envelopes and ErrorMessage must
+// never change shape, so any two versions can at least explain to each
+// other why they can't play.
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Hello opens every connection, from the client, before the server says
+// anything. A client that offers encodings gets a Hello back naming the
+// one the server picked.
+type Hello struct {
+	Version   int      `json:"version"`             // protocolVersion the sender speaks
+	Encodings []string `json:"encodings,omitempty"` // encodings the client can speak, best first
+	Encoding  string   `json:"encoding,omitempty"`  // the server's pick from Encodings
+}
+
+// Encodings a connection can agree on. Every peer speaks JSON envelopes;
+// binary also packs the messages sent every tick into fixed-width frames,
+// and anything else stays JSON.
+const (
+	encodingJSON   = "json"
+	encodingBinary = "binary"
+)
+
+// PlayerCount tells players how many people are online.
+type PlayerCount struct {
+	Count int `json:"count"`
+}
+
+// helloWait is how long the server waits for a client's hello. Clients
+// from before the handshake never send one.
+const helloWait = 3 * time.Second
+
+// messageType names each message on the wire.
+func messageType(v interface{}) (string, error) {
+	switch v.(type) {
+	case Hello:
+		return "hello", nil
+	case ErrorMessage:
+		return "error", nil
+	case RemoteState:
+		return "state", nil
+	case PlayerCount:
+		return "player_count", nil
+	case StateAck:
+		return "ack", nil
+	case HealthUpdate:
+		return "health", nil
+	case RoundStart:
+		return "round_start", nil
+	case MatchResult:
+		return "match_result", nil
+	case HighScoreSubmit:
+		return "highscore_submit", nil
+	case HighScoreAccepted:
+		return "highscore_accepted", nil
+	case RematchRequest:
+		return "rematch", nil
+	case RematchDeclined:
+		return "rematch_declined", nil
+	case QueueInfo:
+		return "queued", nil
+	case RoomInfo:
+		return "room", nil
+	case SessionInfo:
+		return "session", nil
+	case OpponentStatus:
+		return "opponent_status", nil
+	case LobbySnapshot:
+		return "spectate", nil
+	}
+	return "", fmt.Errorf("no message type for %T", v)
+}
+
+// encodeMessage wraps v in an envelope.
+func encodeMessage(v interface{}) ([]byte, error) {
+	typ, err := messageType(v)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Envelope{Version: protocolVersion, Type: typ, Data: data})
+}
+
+// decodeMessage unwraps an envelope into the message it names, as a value
+// of that message's type. Types this version doesn't know decode to nil,
+// so newer peers can add messages without breaking older ones.
+func decodeMessage(raw []byte) (interface{}, error) {
+	var env Envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return nil, err
+	}
+	var msg interface{}
+	var err error
+	switch env.Type {
+	case "hello":
+		var m Hello
+		err = json.Unmarshal(env.Data, &m)
+		msg = m
+	case "error":
+		var m ErrorMessage
+		err = json.Unmarshal(env.Data, &m)
+		msg = m
+	case "state":
+		var m RemoteState
+		err = json.Unmarshal(env.Data, &m)
+		msg = m
+	case "player_count":
+		var m PlayerCount
+		err = json.Unmarshal(env.Data, &m)
+		msg = m
+	case "ack":
+		var m StateAck
+		err = json.Unmarshal(env.Data, &m)
+		msg = m
+	case "health":
+		var m HealthUpdate
+		err = json.Unmarshal(env.Data, &m)
+		msg = m
+	case "round_start":
+		var m RoundStart
+		err = json.Unmarshal(env.Data, &m)
+		msg = m
+	case "match_result":
+		var m MatchResult
+		err = json.Unmarshal(env.Data, &m)
+		msg = m
+	case "highscore_submit":
+		var m HighScoreSubmit
+		err = json.Unmarshal(env.Data, &m)
+		msg = m
+	case "highscore_accepted":
+		var m HighScoreAccepted
+		err = json.Unmarshal(env.Data, &m)
+		msg = m
+	case "rematch":
+		var m RematchRequest
+		err = json.Unmarshal(env.Data, &m)
+		msg = m
+	case "rematch_declined":
+		msg = RematchDeclined{}
+	case "queued":
+		var m QueueInfo
+		err = json.Unmarshal(env.Data, &m)
+		msg = m
+	case "room":
+		var m RoomInfo
+		err = json.Unmarshal(env.Data, &m)
+		msg = m
+	case "session":
+		var m SessionInfo
+		err = json.Unmarshal(env.Data, &m)
+		msg = m
+	case "opponent_status":
+		var m OpponentStatus
+		err = json.Unmarshal(env.Data, &m)
+		msg = m
+	case "spectate":
+		var m LobbySnapshot
+		err = json.Unmarshal(env.Data, &m)
+		msg = m
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bad %s message: %w", env.Type, err)
+	}
+	return msg, nil
+}
+
+// Binary message codes, the first byte of every binary frame.
+const (
+	binaryState       = 1
+	binaryAck         = 2
+	binaryPlayerCount = 3
+)
+
+// Sizes of the binary frames, code byte included. Numbers are big-endian:
+// seq is 32 bits and positions and HP are 16, signed.
+const (
+	binaryStateSize       = 13 // code, seq, x, y, hp, facing, flags
+	binaryAckSize         = 9  // code, seq, x, y
+	binaryPlayerCountSize = 5  // code, count
+)
+
+// Flag bits in a binary state.
+const (
+	binaryFlagAttack  = 1 << 0
+	binaryFlagPlayer1 = 1 << 1
+)
+
+// encodeBinary packs v into a binary frame. It reports false for messages
+// with no binary form, or values that don't fit one, which go as JSON.
+func encodeBinary(v interface{}) ([]byte, bool) {
+	fits := func(n int) bool { return n >= math.MinInt16 && n <= math.MaxInt16 }
+	switch m := v.(type) {
+	case RemoteState:
+		if !fits(m.X) || !fits(m.Y) || !fits(m.HP) || m.Facing < 0 || m.Facing > math.MaxUint8 {
+			return nil, false
+		}
+		b := make([]byte, binaryStateSize)
+		b[0] = binaryState
+		binary.BigEndian.PutUint32(b[1:], m.Seq)
+		binary.BigEndian.PutUint16(b[5:], uint16(m.X))
+		binary.BigEndian.PutUint16(b[7:], uint16(m.Y))
+		binary.BigEndian.PutUint16(b[9:], uint16(m.HP))
+		b[11] = byte(m.Facing)
+		if m.Attack {
+			b[12] |= binaryFlagAttack
+		}
+		if m.Player1 {
+			b[12] |= binaryFlagPlayer1
+		}
+		return b, true
+	case StateAck:
+		if !fits(m.X) || !fits(m.Y) {
+			return nil, false
+		}
+		b := make([]byte, binaryAckSize)
+		b[0] = binaryAck
+		binary.BigEndian.PutUint32(b[1:], m.Seq)
+		binary.BigEndian.PutUint16(b[5:], uint16(m.X))
+		binary.BigEndian.PutUint16(b[7:], uint16(m.Y))
+		return b, true
+	case PlayerCount:
+		if m.Count < 0 || uint64(m.Count) > math.MaxUint32 {
+			return nil, false
+		}
+		b := make([]byte, binaryPlayerCountSize)
+		b[0] = binaryPlayerCount
+		binary.BigEndian.PutUint32(b[1:], uint32(m.Count))
+		return b, true
+	}
+	return nil, false
+}
+
+// decodeBinary unpacks a binary frame. Codes this version doesn't know
+// decode to nil, like unknown envelope types.
+func decodeBinary(b []byte) (interface{}, error) {
+	if len(b) == 0 {
+		return nil, errors.New("empty binary message")
+	}
+	short := func(size int) bool { return len(b) < size }
+	i16 := func(at int) int { return int(int16(binary.BigEndian.Uint16(b[at:]))) }
+	switch b[0] {
+	case binaryState:
+		if short(binaryStateSize) {
+			break
+		}
+		return RemoteState{
+			Seq:     binary.BigEndian.Uint32(b[1:]),
+			X:       i16(5),
+			Y:       i16(7),
+			HP:      i16(9),
+			Facing:  rune(b[11]),
+			Attack:  b[12]&binaryFlagAttack != 0,
+			Player1: b[12]&binaryFlagPlayer1 != 0,
+		}, nil
+	case binaryAck:
+		if short(binaryAckSize) {
+			break
+		}
+		return StateAck{Seq: binary.BigEndian.Uint32(b[1:]), X: i16(5), Y: i16(7)}, nil
+	case binaryPlayerCount:
+		if short(binaryPlayerCountSize) {
+			break
+		}
+		return PlayerCount{Count: int(binary.BigEndian.Uint32(b[1:]))}, nil
+	default:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("short binary message %d: %d bytes", b[0], len(b))
+}
+
+// frame is a message encoded for the wire, with its websocket frame type.
+type frame struct {
+	kind int // websocket.TextMessage or websocket.BinaryMessage
+	data []byte
+}
+
+// encodeFrame encodes v for a connection, as binary if it agreed to
+// binary and v has a binary form, else as a JSON envelope.
+func encodeFrame(v interface{}, useBinary bool) (frame, error) {
+	if useBinary {
+		if data, ok := encodeBinary(v); ok {
+			return frame{websocket.BinaryMessage, data}, nil
+		}
+	}
+	data, err := encodeMessage(v)
+	return frame{websocket.TextMessage, data}, err
+}
+
+// decodeFrame decodes a message of either frame type.
+func decodeFrame(kind int, raw []byte) (interface{}, error) {
+	if kind == websocket.BinaryMessage {
+		return decodeBinary(raw)
+	}
+	return decodeMessage(raw)
+}
+
+// writeMessage sends v on c as JSON, which every peer can read. Callers
+// must make sure they're c's only writer.
+func writeMessage(c *websocket.Conn, v interface{}) error {
+	return writeEncoded(c, v, false)
+}
+
+// writeEncoded sends v on c in the encoding the connection agreed on.
+// Callers must make sure they're c's only writer.
+func writeEncoded(c *websocket.Conn, v interface{}, useBinary bool) error {
+	f, err := encodeFrame(v, useBinary)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(f.kind, f.data)
+}
+
+// readMessage reads c's next message, skipping any that are malformed or
+// of a type this version doesn't know.
+func readMessage(c *websocket.Conn) (interface{}, error) {
+	for {
+		kind, raw, err := c.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msg, err := decodeFrame(kind, raw); err == nil && msg != nil {
+			return msg, nil
+		}
+	}
+}
+
+// SERVER
+
+// greet waits for a new connection's hello, turning away clients that
+// speak another protocol version with a message saying which side needs
+// upgrading. It returns the hello and whether the client can play.
+func greet(c *websocket.Conn) (Hello, bool) {
+	c.SetReadDeadline(time.Now().Add(helloWait))
+	_, raw, err := c.ReadMessage()
+	c.SetReadDeadline(time.Time{})
+
+	var env Envelope
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() || err == nil && (json.Unmarshal(raw, &env) != nil || env.Version == 0) {
+		// Clients from before the handshake wait for us to speak first and
+		// read whatever we say as their starting state, so no message would
+		// be shown. They do print why a read failed, which for a close frame
+		// includes its reason.
+		reason := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "this server needs a newer duel; please upgrade (brew upgrade duel)")
+		c.WriteControl(websocket.CloseMessage, reason, time.Now().Add(playerWriteWait))
+		c.Close()
+		return Hello{}, false
+	}
+	if err != nil {
+		c.Close()
+		return Hello{}, false
+	}
+
+	var hello Hello
+	if env.Type == "hello" {
+		json.Unmarshal(env.Data, &hello)
+	}
+	if hello.Version == protocolVersion {
+		return hello, true
+	}
+	msg := fmt.Sprintf("this server speaks protocol v%d but your duel speaks v%d; ", protocolVersion, hello.Version)
+	if hello.Version < protocolVersion {
+		msg += "please upgrade duel (brew upgrade duel)"
+	} else {
+		msg += "ask the server's host to upgrade"
+	}
+	writeMessage(c, ErrorMessage{Message: msg})
+	c.Close()
+	return Hello{}, false
+}
+
+// agreeEncoding picks the first encoding the client offered that we speak
+// and tells the client, reporting whether it's binary. Clients that offer
+// nothing get JSON without being told.
+func agreeEncoding(c *websocket.Conn, hello Hello) bool {
+	if len(hello.Encodings) == 0 {
+		return false
+	}
+	pick := encodingJSON
+	for _, enc := range hello.Encodings {
+		if enc == encodingJSON || enc == encodingBinary {
+			pick = enc
+			break
+		}
+	}
+	writeMessage(c, Hello{Version: protocolVersion, Encoding: pick})
+	return pick == encodingBinary
+}
+
+// CLIENT
+
+// refusedError is the server's reason for turning us away, as opposed to
+// the connection failing.
+type refusedError string
+
+func (e refusedError) Error() string { return string(e) }
+
+// clientEncodings are the encodings players offer the server. DUEL_WIRE=json
+// sticks to JSON, which is easier to read in a packet capture.
+func clientEncodings() []string {
+	if os.Getenv("DUEL_WIRE") == encodingJSON {
+		return []string{encodingJSON}
+	}
+	return []string{encodingBinary, encodingJSON}
+}
+
+// handshake says hello to the server, offering encodings, and returns its
+// first message and whether it agreed to binary. If it won't let us play,
+// the error is a refusedError saying why.
+func handshake(c *websocket.Conn, encodings []string) (first interface{}, useBinary bool, err error) {
+	if err := writeMessage(c, Hello{Version: protocolVersion, Encodings: encodings}); err != nil {
+		return nil, false, err
+	}
+	for {
+		kind, raw, err := c.ReadMessage()
+		if err != nil {
+			return nil, false, err
+		}
+		var env Envelope
+		if kind == websocket.TextMessage && (json.Unmarshal(raw, &env) != nil || env.Version == 0) {
+			return nil, false, refusedError("the server runs an older duel; ask its host to upgrade")
+		}
+		msg, err := decodeFrame(kind, raw)
+		if err != nil {
+			return nil, false, err
+		}
+		if refused, ok := msg.(ErrorMessage); ok {
+			return nil, false, refusedError(refused.Message)
+		}
+		if kind == websocket.TextMessage && env.Version != protocolVersion {
+			return nil, false, refusedError(fmt.Sprintf("the server speaks protocol v%d but this duel speaks v%d", env.Version, protocolVersion))
+		}
+		if reply, ok := msg.(Hello); ok {
+			useBinary = reply.Encoding == encodingBinary
+			continue
+		}
+		return msg, useBinary, nil
+	}
+}
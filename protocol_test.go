@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestBinaryRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  interface{}
+		size int
+	}{
+		{"state", RemoteState{Seq: 7, X: 10, Y: 12, HP: 100, Facing: 'd'}, binaryStateSize},
+		{"state negative", RemoteState{X: -3, Y: -1, HP: -20, Facing: 'a'}, binaryStateSize},
+		{"state bounds", RemoteState{Seq: math.MaxUint32, X: math.MinInt16, Y: math.MaxInt16, HP: math.MinInt16, Facing: math.MaxUint8}, binaryStateSize},
+		{"state attack", RemoteState{Seq: 1, X: 5, Y: 5, HP: 50, Facing: 'w', Attack: true}, binaryStateSize},
+		{"state player1", RemoteState{Seq: 1, X: 5, Y: 5, HP: 50, Facing: 's', Player1: true}, binaryStateSize},
+		{"state both flags", RemoteState{Seq: 2, X: 5, Y: 5, HP: 50, Facing: 's', Attack: true, Player1: true}, binaryStateSize},
+		{"ack", StateAck{Seq: 42, X: 30, Y: 8}, binaryAckSize},
+		{"ack bounds", StateAck{Seq: math.MaxUint32, X: math.MinInt16, Y: math.MaxInt16}, binaryAckSize},
+		{"player count", PlayerCount{Count: 12}, binaryPlayerCountSize},
+		{"player count zero", PlayerCount{}, binaryPlayerCountSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, ok := encodeBinary(tt.msg)
+			if !ok {
+				t.Fatalf("encodeBinary(%+v) has no binary form", tt.msg)
+			}
+			if len(b) != tt.size {
+				t.Errorf("frame is %d bytes, want %d", len(b), tt.size)
+			}
+			got, err := decodeBinary(b)
+			if err != nil {
+				t.Fatalf("decodeBinary: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.msg) {
+				t.Errorf("round trip = %+v, want %+v", got, tt.msg)
+			}
+		})
+	}
+}
+
+func TestDecodeBinaryShort(t *testing.T) {
+	full := map[byte]interface{}{
+		binaryState:       RemoteState{Seq: 1, X: 2, Y: 3, HP: 4, Facing: 'd'},
+		binaryAck:         StateAck{Seq: 1, X: 2, Y: 3},
+		binaryPlayerCount: PlayerCount{Count: 1},
+	}
+	for code, msg := range full {
+		b, _ := encodeBinary(msg)
+		for n := 1; n < len(b); n++ {
+			if got, err := decodeBinary(b[:n]); err == nil {
+				t.Errorf("decodeBinary of code %d cut to %d bytes = %+v, want error", code, n, got)
+			}
+		}
+	}
+	if _, err := decodeBinary(nil); err == nil {
+		t.Error("decodeBinary of empty frame didn't fail")
+	}
+}
+
+func TestDecodeBinaryUnknown(t *testing.T) {
+	for _, b := range [][]byte{{0}, {99}, {99, 1, 2, 3}, {255}} {
+		got, err := decodeBinary(b)
+		if got != nil || err != nil {
+			t.Errorf("decodeBinary(%v) = %v, %v; want nil, nil", b, got, err)
+		}
+	}
+}
+
+func TestEncodeFrameFallsBackToJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  interface{}
+	}{
+		{"x too big", RemoteState{X: math.MaxInt16 + 1}},
+		{"y too small", RemoteState{Y: math.MinInt16 - 1}},
+		{"hp too big", RemoteState{HP: 1 << 20}},
+		{"facing too big", RemoteState{Facing: math.MaxUint8 + 1}},
+		{"negative facing", RemoteState{Facing: -1}},
+		{"ack out of range", StateAck{X: math.MaxInt16 + 1}},
+		{"negative count", PlayerCount{Count: -1}},
+		{"no binary form", RematchDeclined{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := encodeFrame(tt.msg, true)
+			if err != nil {
+				t.Fatalf("encodeFrame: %v", err)
+			}
+			if f.kind != websocket.TextMessage {
+				t.Fatalf("frame kind = %d, want text", f.kind)
+			}
+			got, err := decodeFrame(f.kind, f.data)
+			if err != nil {
+				t.Fatalf("decodeFrame: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.msg) {
+				t.Errorf("round trip = %+v, want %+v", got, tt.msg)
+			}
+		})
+	}
+}
+
+func TestEncodeUnknownMessage(t *testing.T) {
+	type unregistered struct{ N int }
+	if _, err := encodeMessage(unregistered{}); err == nil {
+		t.Error("encoding a message with no type didn't fail")
+	}
+}
+
+// dialTest runs serve on the server end of a fresh websocket connection
+// and returns the client end.
+func dialTest(t *testing.T, serve func(c *websocket.Conn)) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		serve(c)
+	}))
+	t.Cleanup(srv.Close)
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return c
+}
+
+func TestGreet(t *testing.T) {
+	envelope := func(v int, msg interface{}) []byte {
+		data, _ := json.Marshal(msg)
+		raw, _ := json.Marshal(Envelope{Version: v, Type: "hello", Data: data})
+		return raw
+	}
+	tests := []struct {
+		name     string
+		hello    []byte
+		wantOK   bool
+		wantSays string // in the error the client is sent, or the close reason
+	}{
+		{"same version", envelope(protocolVersion, Hello{Version: protocolVersion, Encodings: []string{encodingBinary}}), true, ""},
+		{"older client", envelope(1, Hello{Version: 1}), false, "please upgrade duel"},
+		{"newer client", envelope(protocolVersion+1, Hello{Version: protocolVersion + 1}), false, "ask the server's host to upgrade"},
+		{"not an envelope", []byte(`{"x":10,"y":12}`), false, "this server needs a newer duel"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			type greeted struct {
+				hello Hello
+				ok    bool
+			}
+			done := make(chan greeted, 1)
+			c := dialTest(t, func(c *websocket.Conn) {
+				hello, ok := greet(c)
+				done <- greeted{hello, ok}
+			})
+			if err := c.WriteMessage(websocket.TextMessage, tt.hello); err != nil {
+				t.Fatal(err)
+			}
+			got := <-done
+			if got.ok != tt.wantOK {
+				t.Fatalf("greet ok = %v, want %v", got.ok, tt.wantOK)
+			}
+			if tt.wantOK {
+				if got.hello.Version != protocolVersion || len(got.hello.Encodings) != 1 {
+					t.Errorf("greet returned %+v", got.hello)
+				}
+				return
+			}
+
+			// Turned away: either an error message or a close frame says why
+			var said string
+			_, raw, err := c.ReadMessage()
+			if err == nil {
+				msg, derr := decodeMessage(raw)
+				if e, ok := msg.(ErrorMessage); derr == nil && ok {
+					said = e.Message
+				}
+			} else {
+				said = err.Error()
+			}
+			if !strings.Contains(said, tt.wantSays) {
+				t.Errorf("client was told %q, want it to say %q", said, tt.wantSays)
+			}
+		})
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	tests := []struct {
+		name       string
+		reply      func(c *websocket.Conn)
+		wantFirst  interface{}
+		wantBinary bool
+		wantRefuse string // in the refusedError, "" if we get to play
+	}{
+		{
+			name: "json server",
+			reply: func(c *websocket.Conn) {
+				writeMessage(c, Hello{Version: protocolVersion, Encoding: encodingJSON})
+				writeMessage(c, RemoteState{X: 10, Y: 12, HP: 100})
+			},
+			wantFirst: RemoteState{X: 10, Y: 12, HP: 100},
+		},
+		{
+			name: "binary server",
+			reply: func(c *websocket.Conn) {
+				writeMessage(c, Hello{Version: protocolVersion, Encoding: encodingBinary})
+				writeEncoded(c, RemoteState{X: 10, Y: 12, HP: 100}, true)
+			},
+			wantFirst:  RemoteState{X: 10, Y: 12, HP: 100},
+			wantBinary: true,
+		},
+		{
+			name: "server turns us away",
+			reply: func(c *websocket.Conn) {
+				writeMessage(c, ErrorMessage{Message: "please upgrade duel"})
+			},
+			wantRefuse: "please upgrade duel",
+		},
+		{
+			name: "older server",
+			reply: func(c *websocket.Conn) {
+				data, _ := json.Marshal(RemoteState{X: 10})
+				raw, _ := json.Marshal(Envelope{Version: 1, Type: "state", Data: data})
+				c.WriteMessage(websocket.TextMessage, raw)
+			},
+			wantRefuse: "the server speaks protocol v1",
+		},
+		{
+			name: "server from before envelopes",
+			reply: func(c *websocket.Conn) {
+				c.WriteJSON(RemoteState{X: 10, Y: 12, HP: 100, Player1: true})
+			},
+			wantRefuse: "the server runs an older duel",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dialTest(t, func(c *websocket.Conn) {
+				msg, err := readMessage(c)
+				if hello, ok := msg.(Hello); err != nil || !ok || hello.Version != protocolVersion {
+					return
+				}
+				tt.reply(c)
+				// Stay open until the client has read the reply
+				c.ReadMessage()
+			})
+			first, useBinary, err := handshake(c, []string{encodingBinary, encodingJSON})
+
+			var refused refusedError
+			if tt.wantRefuse != "" {
+				if !errors.As(err, &refused) || !strings.Contains(string(refused), tt.wantRefuse) {
+					t.Fatalf("handshake error = %v, want refusal saying %q", err, tt.wantRefuse)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handshake: %v", err)
+			}
+			if !reflect.DeepEqual(first, tt.wantFirst) || useBinary != tt.wantBinary {
+				t.Errorf("handshake = %+v, binary %v; want %+v, binary %v", first, useBinary, tt.wantFirst, tt.wantBinary)
+			}
+		})
+	}
+}
+
+// benchLobbies is how many concurrent lobbies the benchmarks simulate.
+const benchLobbies = 300
+
+// benchServer seats two players in each of benchLobbies lobbies, all on one
+// encoding. Players have no connection; the benchmarks drain their queues.
+func benchServer(useBinary bool) []*Lobby {
+	ls := make([]*Lobby, benchLobbies)
+	for i := range ls {
+		l := &Lobby{ID: i, Round: 1, BestOf: 1}
+		for seat := range l.Players {
+			p := &Player{
+				Lobby:  l,
+				binary: useBinary,
+				send:   make(chan frame, playerQueueSize),
+				done:   make(chan struct{}),
+			}
+			p.State = RemoteState{X: 10 + 55*seat, Y: 12, HP: 100, Facing: 'd', Player1: seat == 0}
+			l.Players[seat] = p
+		}
+		ls[i] = l
+	}
+	return ls
+}
+
+// drain empties every player's queue, returning the bytes that would
+// have gone out on the wire.
+func drain(ls []*Lobby) int {
+	n := 0
+	for _, l := range ls {
+		for _, p := range l.Players {
+			for len(p.send) > 0 {
+				n += len((<-p.send).data)
+			}
+		}
+	}
+	return n
+}
+
+func benchEncodings(b *testing.B, run func(b *testing.B, useBinary bool)) {
+	for _, enc := range []string{encodingJSON, encodingBinary} {
+		b.Run(enc, func(b *testing.B) { run(b, enc == encodingBinary) })
+	}
+}
+
+// reportWire reports bytes sent per op, and per second if an op happens
+// every opEvery ticks.
+func reportWire(b *testing.B, bytes int, opEvery float64) {
+	perOp := float64(bytes) / float64(b.N)
+	b.ReportMetric(perOp, "wire-B/op")
+	b.ReportMetric(perOp/(opEvery*tickRate.Seconds()), "wire-B/s")
+}
+
+// BenchmarkLobbyTick is one server tick with every knight in every lobby
+// sending a state: decode it, ack it and pass it on to the opponent. At
+// one op per tick, ns/op over tickRate is the share of a core the server
+// spends on it.
+func BenchmarkLobbyTick(b *testing.B) {
+	benchEncodings(b, func(b *testing.B, useBinary bool) {
+		ls := benchServer(useBinary)
+		incoming := make([][2]frame, len(ls))
+		for i, l := range ls {
+			for seat, p := range l.Players {
+				f, err := encodeFrame(RemoteState{Seq: 1, X: p.State.X, Y: p.State.Y, Attack: true, Facing: p.State.Facing}, useBinary)
+				if err != nil {
+					b.Fatal(err)
+				}
+				incoming[i][seat] = f
+			}
+		}
+
+		bytes := 0
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			for i, l := range ls {
+				for seat, p := range l.Players {
+					in := incoming[i][seat]
+					bytes += len(in.data)
+					msg, err := decodeFrame(in.kind, in.data)
+					if err != nil {
+						b.Fatal(err)
+					}
+					st := msg.(RemoteState)
+					l.mu.Lock()
+					x, y := p.validateMove(st.X, st.Y)
+					p.State.X, p.State.Y, p.State.Facing = x, y, st.Facing
+					l.mu.Unlock()
+					p.sendMessage(StateAck{Seq: st.Seq, X: x, Y: y})
+					broadcastToLobby(l, p, st.Attack)
+				}
+			}
+			bytes += drain(ls)
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N)/float64(tickRate.Nanoseconds())*100, "%core")
+		reportWire(b, bytes, 1)
+	})
+}
+
+// BenchmarkPlayerCount is one player-count broadcast to everyone online,
+// sent on every join and leave. wire-B/s assumes one a second.
+func BenchmarkPlayerCount(b *testing.B) {
+	benchEncodings(b, func(b *testing.B, useBinary bool) {
+		saved, savedTotal := lobbies, totalPlayers
+		defer func() { lobbies, totalPlayers = saved, savedTotal }()
+		lobbies = benchServer(useBinary)
+		totalPlayers = 2 * benchLobbies
+
+		bytes := 0
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			broadcastPlayerCount()
+			bytes += drain(lobbies)
+		}
+		reportWire(b, bytes, float64(time.Second)/float64(tickRate))
+	})
+}
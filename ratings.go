@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Elo tuning. Everyone starts at defaultRating; eloK caps how far a single
+// round can move a rating.
+const (
+	defaultRating = 1500
+	eloK          = 32
+)
+
+// RatingStore persists each named player's Elo rating. The stores returned
+// by newRatingStore compare names case-insensitively, like identities.
+type RatingStore interface {
+	// Get returns the player's rating, or defaultRating if they're new.
+	Get(name string) (int, error)
+	Set(name string, rating int) error
+}
+
+// newRatingStore picks a backend by name; see storageKind for the default.
+func newRatingStore(kind, path string) (RatingStore, error) {
+	switch storageKind(kind) {
+	case "memory":
+		return caselessRatings{&memoryRatings{}}, nil
+	case "file":
+		store, err := openFileRatings(path)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("Using ratings file", path)
+		return caselessRatings{store}, nil
+	case "upstash":
+		client, err := newUpstashClient()
+		if err != nil {
+			return nil, err
+		}
+		return caselessRatings{&upstashRatings{client}}, nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", kind)
+}
+
+// ratingKey is the name a rating is stored under. Names are claimed
+// case-insensitively, so "ALICE" is the same player as "alice" and must
+// not get a fresh rating.
+func ratingKey(name string) string {
+	return strings.ToLower(name)
+}
+
+// caselessRatings stores every rating under its ratingKey.
+type caselessRatings struct {
+	RatingStore
+}
+
+func (c caselessRatings) Get(name string) (int, error) {
+	return c.RatingStore.Get(ratingKey(name))
+}
+
+func (c caselessRatings) Set(name string, rating int) error {
+	return c.RatingStore.Set(ratingKey(name), rating)
+}
+
+// eloUpdate returns the new ratings after winner beats loser.
+func eloUpdate(winner, loser int) (int, int) {
+	expected := 1 / (1 + math.Pow(10, float64(loser-winner)/400))
+	delta := int(math.Round(eloK * (1 - expected)))
+	return winner + delta, loser - delta
+}
+
+// MEMORY
+
+type memoryRatings struct {
+	mu      sync.Mutex
+	ratings map[string]int
+}
+
+func (m *memoryRatings) Get(name string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.ratings[name]; ok {
+		return r, nil
+	}
+	return defaultRating, nil
+}
+
+func (m *memoryRatings) Set(name string, rating int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(name, rating)
+	return nil
+}
+
+// set records a rating. Caller must hold m.mu.
+func (m *memoryRatings) set(name string, rating int) {
+	if m.ratings == nil {
+		m.ratings = make(map[string]int)
+	}
+	m.ratings[name] = rating
+}
+
+// FILE
+
+// fileRatings is a memoryRatings that rewrites a JSON file on every change.
+type fileRatings struct {
+	memoryRatings
+	path string
+}
+
+func openFileRatings(path string) (*fileRatings, error) {
+	f := &fileRatings{path: path}
+	if err := readJSONFile(path, &f.ratings); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *fileRatings) Set(name string, rating int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.set(name, rating)
+	return writeJSONFile(f.path, f.ratings)
+}
+
+// UPSTASH
+
+// upstashRatings keeps ratings in a Redis hash keyed by player name.
+type upstashRatings struct {
+	upstashClient
+}
+
+func (u *upstashRatings) Get(name string) (int, error) {
+	result, err := u.request([]interface{}{"HGET", "ratings", name})
+	if err != nil {
+		return defaultRating, err
+	}
+	s, ok := result.(string)
+	if !ok {
+		// nil result: never rated
+		return defaultRating, nil
+	}
+	return strconv.Atoi(s)
+}
+
+func (u *upstashRatings) Set(name string, rating int) error {
+	_, err := u.request([]interface{}{"HSET", "ratings", name, rating})
+	return err
+}
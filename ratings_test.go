@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestEloUpdate(t *testing.T) {
+	tests := []struct {
+		name                  string
+		winner, loser         int
+		wantWinner, wantLoser int
+	}{
+		{"even", 1500, 1500, 1516, 1484},
+		{"favourite wins", 1700, 1500, 1708, 1492},
+		{"underdog wins", 1500, 1700, 1524, 1676},
+		{"huge favourite wins", 2400, 1000, 2400, 1000},
+		{"huge underdog wins", 1000, 2400, 1032, 2368},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, l := eloUpdate(tt.winner, tt.loser)
+			if w != tt.wantWinner || l != tt.wantLoser {
+				t.Errorf("eloUpdate(%d, %d) = %d, %d; want %d, %d",
+					tt.winner, tt.loser, w, l, tt.wantWinner, tt.wantLoser)
+			}
+			if w+l != tt.winner+tt.loser {
+				t.Errorf("ratings not conserved: %d+%d != %d+%d", w, l, tt.winner, tt.loser)
+			}
+		})
+	}
+}
+
+func TestRatingsIgnoreNameCase(t *testing.T) {
+	store, err := newRatingStore("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("alice", 1640); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "ALICE", "Alice"} {
+		if got, _ := store.Get(name); got != 1640 {
+			t.Errorf("Get(%q) = %d, want alice's 1640", name, got)
+		}
+	}
+	store.Set("ALICE", 1610)
+	if got, _ := store.Get("alice"); got != 1610 {
+		t.Errorf("after saving as ALICE, alice has %d, want 1610", got)
+	}
+	if got, _ := store.Get("bob"); got != defaultRating {
+		t.Errorf("Get(bob) = %d, want the default %d", got, defaultRating)
+	}
+}
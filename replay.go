@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Replays are gzipped JSON lines: a ReplayHeader, then one ReplayEvent per
+// line. Bump replayVersion whenever an event's meaning changes so old
+// files can still be told apart and read.
+const (
+	replayFormat  = "cli-duel-replay"
+	replayVersion = 1
+)
+
+// ReplayHeader opens every replay file.
+type ReplayHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	Source    string    `json:"source"` // "server", or "client" for a player's own recording
+	LobbyID   int       `json:"lobby_id,omitempty"`
+	BestOf    int       `json:"best_of"`
+	Players   [2]string `json:"players"` // left and right knight, empty if anonymous or unknown
+	StartedAt time.Time `json:"started_at"`
+}
+
+// ReplayEvent is one timestamped message. State is a knight's state, with
+// Player1 saying which one; Result ends a round and is always from the
+// left knight's point of view.
+type ReplayEvent struct {
+	T      int64        `json:"t"` // ms since StartedAt
+	State  *RemoteState `json:"s,omitempty"`
+	Result *MatchResult `json:"r,omitempty"`
+}
+
+// replayRecorder writes a replay file as a match is played. A nil recorder
+// records nothing, so callers needn't check whether recording is on.
+type replayRecorder struct {
+	file  *os.File
+	buf   *bufio.Writer
+	gz    *gzip.Writer
+	enc   *json.Encoder
+	start time.Time
+}
+
+// newReplayRecorder creates path and writes the header.
+func newReplayRecorder(path string, header ReplayHeader) (*replayRecorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &replayRecorder{file: file, start: time.Now()}
+	r.buf = bufio.NewWriter(file)
+	r.gz = gzip.NewWriter(r.buf)
+	r.enc = json.NewEncoder(r.gz)
+
+	header.Format, header.Version = replayFormat, replayVersion
+	header.StartedAt = r.start
+	if err := r.enc.Encode(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// replayPath names a server replay after its lobby and start time.
+func replayPath(dir string, lobbyID int) string {
+	name := fmt.Sprintf("lobby%d-%s.replay", lobbyID, time.Now().Format("20060102-150405"))
+	return filepath.Join(dir, name)
+}
+
+func (r *replayRecorder) write(ev ReplayEvent) {
+	if r == nil {
+		return
+	}
+	ev.T = time.Since(r.start).Milliseconds()
+	r.enc.Encode(ev)
+}
+
+// state records a knight's state. Sequence numbers mean nothing in a
+// replay and are dropped.
+func (r *replayRecorder) state(st RemoteState) {
+	st.Seq = 0
+	r.write(ReplayEvent{State: &st})
+}
+
+// result records the end of a round. leftView must already be from the
+// left knight's point of view.
+func (r *replayRecorder) result(leftView MatchResult) {
+	leftView.Token = ""
+	r.write(ReplayEvent{Result: &leftView})
+}
+
+// Close flushes and closes the file.
+func (r *replayRecorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.gz.Close()
+	r.buf.Flush()
+	return r.file.Close()
+}
+
+// SERVER
+
+// startReplay begins recording a new series if the host keeps replays,
+// closing any recording left over from the last one. Caller must hold
+// lobby.mu.
+func (l *Lobby) startReplay() {
+	l.stopReplay()
+	if config.ReplayDir == "" {
+		return
+	}
+	header := ReplayHeader{Source: "server", LobbyID: l.ID, BestOf: l.BestOf}
+	for i, p := range l.Players {
+		if p != nil {
+			header.Players[i] = p.name
+		}
+	}
+	rec, err := newReplayRecorder(replayPath(config.ReplayDir, l.ID), header)
+	if err != nil {
+		fmt.Println("Failed to start replay:", err)
+		return
+	}
+	l.replay = rec
+}
+
+// stopReplay finishes the current recording, if any. Caller must hold
+// lobby.mu.
+func (l *Lobby) stopReplay() {
+	if l.replay == nil {
+		return
+	}
+	if err := l.replay.Close(); err != nil {
+		fmt.Println("Failed to save replay:", err)
+	}
+	l.replay = nil
+}
+
+// leftView turns a player's MatchResult into the left knight's point of
+// view for recording.
+func leftView(r MatchResult, player1 bool) MatchResult {
+	if !player1 {
+		r.Won = !r.Won
+		r.Wins, r.EnemyWins = r.EnemyWins, r.Wins
+		r.Rating, r.RatingChange = 0, 0
+	}
+	return r
+}
+
+// CLIENT
+
+// startClientReplay records this player's view of their session to path,
+// for DUEL_RECORD.
+func startClientReplay(path string, g *Game) {
+	// Players stay blank: the queue can still swap our side after this
+	rec, err := newReplayRecorder(path, ReplayHeader{Source: "client"})
+	if err != nil {
+		fmt.Println("Failed to start recording:", err)
+		return
+	}
+	g.recorder = rec
+}
+
+// recordKnights records where both knights are now, for moments like hits
+// and round starts that don't arrive as state messages.
+func (g *Game) recordKnights() {
+	if g.recorder == nil {
+		return
+	}
+	g.recorder.state(RemoteState{X: g.PlayerX, Y: g.PlayerY, HP: g.hp, Facing: g.facing, Player1: g.isLeft})
+	g.recorder.state(RemoteState{X: g.enemyX, Y: g.enemyY, HP: g.enemyHP, Facing: g.enemyFacing, Player1: !g.isLeft})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeReplay writes a replay file with events at exactly the times given,
+// which a live replayRecorder can't promise.
+func writeReplay(t *testing.T, path string, header ReplayHeader, events []ReplayEvent) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	enc := json.NewEncoder(gz)
+	header.Format, header.Version = replayFormat, replayVersion
+	enc.Encode(header)
+	for _, ev := range events {
+		enc.Encode(ev)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "lobby7.replay")
+	rec, err := newReplayRecorder(path, ReplayHeader{Source: "server", LobbyID: 7, BestOf: 3, Players: [2]string{"alice", ""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.state(RemoteState{Seq: 42, X: 10, Y: 12, HP: 100, Facing: 'd', Player1: true})
+	rec.state(RemoteState{Seq: 9, X: 65, Y: 12, HP: 90, Facing: 'a', Attack: true})
+	rec.result(MatchResult{Won: true, Token: "secret", Round: 1, BestOf: 3, Wins: 1})
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	header, events, err := readReplay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Format != replayFormat || header.Version != replayVersion || header.Source != "server" ||
+		header.LobbyID != 7 || header.BestOf != 3 || header.Players != [2]string{"alice", ""} || header.StartedAt.IsZero() {
+		t.Errorf("header = %+v", header)
+	}
+	if len(events) != 3 {
+		t.Fatalf("read %d events, want 3", len(events))
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].T < events[i-1].T {
+			t.Errorf("event %d at %dms comes before event %d at %dms", i, events[i].T, i-1, events[i-1].T)
+		}
+	}
+	if st := events[0].State; st == nil || *st != (RemoteState{X: 10, Y: 12, HP: 100, Facing: 'd', Player1: true}) {
+		t.Errorf("first event = %+v, want the left knight without its seq", st)
+	}
+	if st := events[1].State; st == nil || !st.Attack || st.Player1 || st.HP != 90 {
+		t.Errorf("second event = %+v, want the right knight's swing", st)
+	}
+	if r := events[2].Result; r == nil || !r.Won || r.Wins != 1 || r.Token != "" {
+		t.Errorf("result event = %+v, want a round 1 win without its token", r)
+	}
+}
+
+func TestReadReplayCutShort(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "full.replay")
+	events := []ReplayEvent{
+		{T: 0, State: &RemoteState{X: 10, HP: 100, Player1: true}},
+		{T: 30, State: &RemoteState{X: 65, HP: 100}},
+		{T: 60, State: &RemoteState{X: 11, HP: 100, Player1: true}},
+	}
+	writeReplay(t, path, ReplayHeader{Source: "server"}, events)
+
+	// The server stopped before the gzip stream was finished
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cut := filepath.Join(dir, "cut.replay")
+	os.WriteFile(cut, data[:len(data)-8], 0o644)
+	if _, got, err := readReplay(cut); err != nil || len(got) != len(events) {
+		t.Errorf("reading a replay cut short = %d events, %v; want %d events", len(got), err, len(events))
+	}
+
+	if _, _, err := readReplay(filepath.Join(dir, "missing.replay")); err == nil {
+		t.Error("read a missing replay without complaint")
+	}
+}
+
+func TestReadReplayNewerVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "newer.replay")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(file)
+	json.NewEncoder(gz).Encode(ReplayHeader{Format: replayFormat, Version: replayVersion + 1})
+	gz.Close()
+	file.Close()
+	if _, _, err := readReplay(path); err == nil {
+		t.Error("read a replay from a newer version without complaint")
+	}
+}
+
+func TestLeftView(t *testing.T) {
+	right := MatchResult{Won: true, Wins: 2, EnemyWins: 1, Rating: 1520, RatingChange: 16}
+	got := leftView(right, false)
+	if got.Won || got.Wins != 1 || got.EnemyWins != 2 || got.Rating != 0 || got.RatingChange != 0 {
+		t.Errorf("leftView of the right knight's win = %+v", got)
+	}
+	if left := leftView(right, true); left != right {
+		t.Errorf("leftView of the left knight's result = %+v, want it unchanged", left)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/rand"
+	"math/big"
+	"net/url"
+	"strings"
+)
+
+// Room codes skip characters that are easy to misread (0/O, 1/I/L).
+const (
+	roomCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+	roomCodeLength   = 5
+)
+
+// newRoomCode returns a code not used by any open lobby. Codes only live as
+// long as their lobby, so they're free again once it empties. Caller must
+// hold lobbyMu.
+func newRoomCode() (string, error) {
+	for {
+		b := make([]byte, roomCodeLength)
+		for i := range b {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(roomCodeAlphabet))))
+			if err != nil {
+				return "", err
+			}
+			b[i] = roomCodeAlphabet[n.Int64()]
+		}
+		code := string(b)
+		if findRoom(code) == nil {
+			return code, nil
+		}
+	}
+}
+
+// findRoom returns the open lobby with the given code, ignoring case.
+// Caller must hold lobbyMu.
+func findRoom(code string) *Lobby {
+	code = strings.ToUpper(code)
+	for _, l := range lobbies {
+		if l.Code != "" && l.Code == code {
+			return l
+		}
+	}
+	return nil
+}
+
+// roomURL adds a room query parameter to a server URL.
+func roomURL(server, room string) string {
+	return withQuery(server, "room", room)
+}
+
+// withQuery sets a query parameter on a server URL.
+func withQuery(server, key, value string) string {
+	u, err := url.Parse(server)
+	if err != nil {
+		return server
+	}
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
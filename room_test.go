@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNewRoomCode(t *testing.T) {
+	savedLobbies := lobbies
+	defer func() { lobbies = savedLobbies }()
+	lobbies = nil
+
+	seen := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		code, err := newRoomCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != roomCodeLength {
+			t.Errorf("code %q is %d long, want %d", code, len(code), roomCodeLength)
+		}
+		for _, r := range code {
+			if !strings.ContainsRune(roomCodeAlphabet, r) {
+				t.Errorf("code %q has %q, which isn't in the alphabet", code, r)
+			}
+		}
+		if seen[code] {
+			t.Errorf("code %q handed out twice", code)
+		}
+		seen[code] = true
+		lobbies = append(lobbies, &Lobby{Code: code})
+	}
+}
+
+func TestJoinRoom(t *testing.T) {
+	savedLobbies, savedTotal := lobbies, totalPlayers
+	defer func() { lobbies, totalPlayers = savedLobbies, savedTotal }()
+	lobbies, totalPlayers = nil, 0
+
+	host := &Player{}
+	room, _, err := joinLobby(host, joinRequest{Room: "new", BestOf: 3})
+	if err != nil {
+		t.Fatalf("opening a room: %v", err)
+	}
+	if room.Code == "" || room.BestOf != 3 || room.Players[0] != host || !host.State.Player1 {
+		t.Fatalf("opened room %+v with the host in it", room)
+	}
+
+	tests := []struct {
+		name    string
+		code    string
+		wantErr string // "" to be seated in the room
+	}{
+		{"unknown code", "ZZZZZ", "room ZZZZZ not found"},
+		{"typed in lower case", strings.ToLower(room.Code), ""},
+		{"full", room.Code, "room " + room.Code + " is full"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guest := &Player{}
+			lobby, online, err := joinLobby(guest, joinRequest{Room: tt.code})
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("joining %q = %v, want error %q", tt.code, err, tt.wantErr)
+				}
+				if guest.Lobby != nil {
+					t.Errorf("refused guest was seated in lobby %d", guest.Lobby.ID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("joining %q: %v", tt.code, err)
+			}
+			if lobby != room || room.Players[1] != guest || guest.State.Player1 {
+				t.Errorf("guest wasn't seated on the right in the room")
+			}
+			if online != 2 {
+				t.Errorf("%d online, want 2", online)
+			}
+		})
+	}
+
+	// Private rooms can't be joined by lobby number
+	if _, _, err := joinLobby(&Player{}, joinRequest{LobbyID: strconv.Itoa(room.ID)}); err == nil {
+		t.Error("joined a private room by its lobby number")
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// RoundStart resets both knights for a new fight in the same lobby, from
+// the point of view of the receiving player.
+type RoundStart struct {
+	Player1 bool `json:"player1"` // which side we're on; can change after matchmaking
+	X       int  `json:"x"`
+	Y       int  `json:"y"`
+	HP      int  `json:"hp"`
+	EnemyX  int  `json:"enemy_x"`
+	EnemyY  int  `json:"enemy_y"`
+	EnemyHP int  `json:"enemy_hp"`
+	// EnemyBot marks an opponent the server filled in with a bot
+	EnemyBot bool `json:"enemy_bot,omitempty"`
+
+	Round     int `json:"round"`
+	BestOf    int `json:"best_of"`
+	Wins      int `json:"wins"`
+	EnemyWins int `json:"enemy_wins"`
+}
+
+// RematchRequest is the client's answer to the rematch prompt.
+type RematchRequest struct {
+	Accept bool `json:"accept"`
+}
+
+// RematchDeclined tells a player waiting on a rematch that it won't happen.
+type RematchDeclined struct{}
+
+// roundBreak is the pause between rounds of a series, long enough to read
+// the round result.
+const roundBreak = 2 * time.Second
+
+// validBestOf reports whether n is a usable series length: odd, so there's
+// always a winner, and short enough to finish.
+func validBestOf(n int) bool {
+	return n >= 1 && n <= 9 && n%2 == 1
+}
+
+// SERVER
+
+// spawn puts a player at their side's starting point with full HP.
+func (p *Player) spawn() {
+	p.State.X, p.State.Y = 65, 12
+	if p.State.Player1 {
+		p.State.X = 10
+	}
+	p.State.HP = 100
+	p.State.Attack = false
+	p.lastAttack = time.Time{}
+	p.lastHit = time.Time{}
+	p.hits = 0
+	p.moveBudget = 0
+	p.lastMoveAt = time.Now()
+}
+
+// startSeries clears the round score and starts round one. Caller must hold
+// lobby.mu and both seats must be filled.
+func startSeries(lobby *Lobby) {
+	lobby.Round = 0
+	lobby.RoundWins = [2]int{}
+	lobby.SeriesOver = false
+	lobby.seriesMs = 0
+	for _, p := range lobby.Players {
+		p.holds = 0
+	}
+	lobby.startReplay()
+	startRound(lobby)
+}
+
+// startRound respawns both players and starts the match clock. Caller must
+// hold lobby.mu and both seats must be filled.
+func startRound(lobby *Lobby) {
+	lobby.MatchEnded = false
+	lobby.roundDue = false
+	lobby.StartTime = time.Now()
+	lobby.Round++
+	for _, p := range lobby.Players {
+		p.spawn()
+		p.wantsRematch = false
+		lobby.replay.state(p.State)
+	}
+	for _, p := range lobby.Players {
+		p.sendMessage(lobby.roundStart(p))
+	}
+	lobby.broadcastSpectators(lobby.snapshot(nil))
+}
+
+// roundStart describes the current round to p, from where both knights
+// are now. Caller must hold l.mu and both seats must be filled.
+func (l *Lobby) roundStart(p *Player) RoundStart {
+	enemy := l.opponent(p)
+	return RoundStart{
+		Player1: p.State.Player1,
+		X:       p.State.X,
+		Y:       p.State.Y,
+		HP:      p.State.HP,
+		EnemyX:  enemy.State.X,
+		EnemyY:  enemy.State.Y,
+		EnemyHP: enemy.State.HP,
+
+		Round:     l.Round,
+		BestOf:    l.BestOf,
+		Wins:      l.RoundWins[l.seat(p)],
+		EnemyWins: l.RoundWins[l.seat(enemy)],
+		EnemyBot:  enemy.bot,
+	}
+}
+
+// handleRematch records a player's answer to the rematch prompt and starts
+// a new round once both players have accepted.
+func handleRematch(p *Player, accept bool) {
+	lobby := p.Lobby
+	lobby.mu.Lock()
+	defer lobby.mu.Unlock()
+
+	if !lobby.SeriesOver {
+		return
+	}
+	other := lobby.opponent(p)
+	if !accept {
+		p.wantsRematch = false
+		if other != nil && other.wantsRematch {
+			other.wantsRematch = false
+			other.sendMessage(RematchDeclined{})
+		}
+		return
+	}
+
+	p.wantsRematch = true
+	if other == nil {
+		p.wantsRematch = false
+		p.sendMessage(RematchDeclined{})
+		return
+	}
+	if other.wantsRematch {
+		fmt.Printf("Rematch starting in lobby %d\n", lobby.ID)
+		startSeries(lobby)
+	}
+}
+
+// CLIENT
+
+// startRound resets our view of the arena to the server's fresh round.
+func (g *Game) startRound(rs RoundStart) {
+	g.queued = false
+	g.isLeft = rs.Player1
+	g.playerColor, g.enemyColor = tcell.ColorBlue, tcell.ColorRed
+	if !g.isLeft {
+		g.playerColor, g.enemyColor = g.enemyColor, g.playerColor
+	}
+
+	g.PlayerX, g.PlayerY = rs.X, rs.Y
+	g.sentX, g.sentY = rs.X, rs.Y
+	g.pending = nil
+	g.hp = rs.HP
+
+	g.enemyConnected = true
+	g.enemyX, g.enemyY = rs.EnemyX, rs.EnemyY
+	g.enemyHP = rs.EnemyHP
+	g.enemyBot = rs.EnemyBot
+	g.enemyBuf = snapshotBuffer{}
+
+	g.facing, g.enemyFacing = 'd', 'a'
+	if !g.isLeft {
+		g.facing, g.enemyFacing = 'a', 'd'
+	}
+
+	g.round, g.bestOf = rs.Round, rs.BestOf
+	g.wins, g.enemyWins = rs.Wins, rs.EnemyWins
+	g.roundBanner = ""
+}
+
+// endRound shows the result of a round that didn't decide the series. The
+// server starts the next one after roundBreak.
+func (g *Game) endRound(result MatchResult) {
+	g.round, g.bestOf = result.Round, result.BestOf
+	g.wins, g.enemyWins = result.Wins, result.EnemyWins
+	g.roundBanner = fmt.Sprintf("ROUND %d LOST", result.Round)
+	if result.Won {
+		g.roundBanner = fmt.Sprintf("ROUND %d WON", result.Round)
+	}
+	if result.RatingChange != 0 {
+		g.rating = result.Rating
+		g.roundBanner += fmt.Sprintf("  (%+d)", result.RatingChange)
+	}
+}
+
+// drawScoreboard shows the round and series score during a best-of-N.
+func (g *Game) drawScoreboard() {
+	if g.bestOf <= 1 {
+		return
+	}
+	score := fmt.Sprintf("Bo%d  Round %d  %d-%d", g.bestOf, g.round, g.wins, g.enemyWins)
+	for i, r := range score {
+		g.screen.SetContent(arenaLeft+5+i, 0, r, nil, tcell.StyleDefault)
+	}
+
+	if g.roundBanner != "" {
+		centerX := (arenaLeft + arenaRight) / 2
+		centerY := (arenaTop + arenaBottom) / 2
+		for i, r := range g.roundBanner {
+			g.screen.SetContent(centerX-len(g.roundBanner)/2+i, centerY-4, r, nil, tcell.StyleDefault.Bold(true))
+		}
+	}
+}
+
+// promptRematch asks whether to play again and, if we accept, waits for
+// the opponent. It returns true once a new round has started.
+func (g *Game) promptRematch(sendMsg func(interface{}), inputChan <-chan *tcell.EventKey, netChan <-chan RemoteState, msgChan <-chan interface{}) bool {
+	centerX := (arenaLeft + arenaRight) / 2
+	centerY := (arenaTop + arenaBottom) / 2
+
+	g.showMessage(centerX, centerY, "Rematch? (Y/N)", tcell.StyleDefault.Bold(true))
+
+	// handle deals with a message from the server, reporting whether the
+	// prompt is done and if so whether a new round started
+	handle := func(msg interface{}) (done, started bool) {
+		switch m := msg.(type) {
+		case RoundStart:
+			g.startRound(m)
+			return true, true
+		case RematchDeclined:
+			g.showMessage(centerX, centerY, "Opponent left", tcell.StyleDefault.Foreground(tcell.ColorRed))
+			time.Sleep(2 * time.Second)
+			return true, false
+		case Disconnected:
+			g.showMessage(centerX, centerY, "Lost connection to the server", tcell.StyleDefault.Foreground(tcell.ColorRed))
+			time.Sleep(2 * time.Second)
+			return true, false
+		case PlayerCount:
+			g.totalPlayers = m.Count
+		}
+		return false, false
+	}
+	// Catch up on whatever arrived while the result screen was up
+	deferred := g.deferred
+	g.deferred = nil
+	for _, msg := range deferred {
+		if done, started := handle(msg); done {
+			return started
+		}
+	}
+
+	accepted := false
+	for {
+		select {
+		case ev := <-inputChan:
+			var r rune
+			if ev.Key() == tcell.KeyRune {
+				r = ev.Rune()
+			}
+			switch {
+			case !accepted && (r == 'y' || r == 'Y'):
+				accepted = true
+				sendMsg(RematchRequest{Accept: true})
+				g.showMessage(centerX, centerY, "Waiting for opponent to accept... (N to leave)", tcell.StyleDefault)
+			case r == 'n' || r == 'N' || r == 'q' || r == 'Q' || ev.Key() == tcell.KeyEscape || ev.Key() == tcell.KeyCtrlC:
+				sendMsg(RematchRequest{Accept: false})
+				return false
+			}
+
+		case <-netChan:
+			// The arena isn't drawn here
+
+		case msg := <-msgChan:
+			if done, started := handle(msg); done {
+				return started
+			}
+		}
+	}
+}
+
+// showMessage clears the screen and draws a single centered line.
+func (g *Game) showMessage(centerX, y int, msg string, style tcell.Style) {
+	g.screen.Clear()
+	for i, r := range msg {
+		g.screen.SetContent(centerX-len(msg)/2+i, y, r, nil, style)
+	}
+	g.screen.Show()
+}
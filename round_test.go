@@ -0,0 +1,211 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeriesScoring(t *testing.T) {
+	tests := []struct {
+		name     string
+		bestOf   int
+		winners  []int // seat winning each round
+		wantWins [2]int
+	}{
+		{"single fight", 1, []int{0}, [2]int{1, 0}},
+		{"best of 3 sweep", 3, []int{1, 1}, [2]int{0, 2}},
+		{"best of 3 decider", 3, []int{0, 1, 0}, [2]int{2, 1}},
+		{"best of 5", 5, []int{1, 0, 1, 0, 1}, [2]int{2, 3}},
+		{"best of 5 sweep", 5, []int{0, 0, 0}, [2]int{3, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _, _ := fightingPair()
+			l.BestOf = tt.bestOf
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			startSeries(l)
+
+			var last MatchResult
+			for i, seat := range tt.winners {
+				if l.Round != i+1 {
+					t.Fatalf("playing round %d, want %d", l.Round, i+1)
+				}
+				winner, loser := l.Players[seat], l.Players[1-seat]
+				for _, p := range l.Players {
+					for len(p.send) > 0 {
+						<-p.send
+					}
+				}
+				// Every round lasts a second
+				l.StartTime = time.Now().Add(-time.Second)
+				endRound(l, winner, loser, false)
+
+				final := i == len(tt.winners)-1
+				if l.SeriesOver != final {
+					t.Fatalf("after round %d series over = %v, want %v", i+1, l.SeriesOver, final)
+				}
+				results := sentResults(t, winner)
+				if len(results) != 1 {
+					t.Fatalf("winner got %d results, want 1", len(results))
+				}
+				r := results[0]
+				last = r
+				if r.Round != i+1 || r.BestOf != tt.bestOf || r.SeriesOver != final {
+					t.Errorf("round %d result = %+v", i+1, r)
+				}
+				if r.Wins != l.RoundWins[seat] || r.EnemyWins != l.RoundWins[1-seat] {
+					t.Errorf("round %d told winner %d-%d, server has %v", i+1, r.Wins, r.EnemyWins, l.RoundWins)
+				}
+				if !final {
+					startRound(l)
+				}
+			}
+			if l.RoundWins != tt.wantWins {
+				t.Errorf("round wins = %v, want %v", l.RoundWins, tt.wantWins)
+			}
+
+			// The high score is for the whole series, not its last round
+			winner := l.Players[tt.winners[len(tt.winners)-1]]
+			want := int64(len(tt.winners)) * 1000
+			if ms := winner.scoreDurationMs; ms < want || ms > want+100 {
+				t.Errorf("token good for %dms, want the series' ~%dms", ms, want)
+			}
+			if last.SeriesMs != winner.scoreDurationMs {
+				t.Errorf("winner shown %dms, token good for %dms", last.SeriesMs, winner.scoreDurationMs)
+			}
+		})
+	}
+}
+
+func TestForfeitEndsSeries(t *testing.T) {
+	l, stayed, left := fightingPair()
+	l.BestOf = 5
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	startSeries(l)
+
+	endRound(l, stayed, left, true)
+	if !l.SeriesOver {
+		t.Error("forfeit in round 1 of 5 didn't end the series")
+	}
+	if stayed.scoreToken != "" {
+		t.Error("a forfeit win was issued a high score token")
+	}
+}
+
+func TestLeaveDuringRoundBreak(t *testing.T) {
+	savedRatings, savedTotal := ratings, totalPlayers
+	defer func() { ratings, totalPlayers = savedRatings, savedTotal }()
+	ratings = &memoryRatings{}
+	totalPlayers = 2
+
+	l, stayed, left := fightingPair()
+	l.BestOf = 3
+	l.mu.Lock()
+	startSeries(l)
+	endRound(l, stayed, left, false)
+	l.mu.Unlock()
+	// Named from here on, so rating the decided round again would show
+	stayed.name, left.name = "alice", "bob"
+	sentResults(t, stayed)
+	rating := stayed.rating
+
+	left.leave()
+	if !l.SeriesOver {
+		t.Fatal("leaving during the break didn't end the series")
+	}
+	if l.RoundWins != [2]int{1, 0} {
+		t.Errorf("round wins = %v, want the decided round counted once", l.RoundWins)
+	}
+	if stayed.rating != rating {
+		t.Errorf("rating moved from %d to %d for an already rated round", rating, stayed.rating)
+	}
+	results := sentResults(t, stayed)
+	if len(results) != 1 {
+		t.Fatalf("stayed player got %d results, want 1", len(results))
+	}
+	if r := results[0]; !r.Won || !r.Forfeit || !r.SeriesOver || r.Wins != 1 || r.EnemyWins != 0 || r.Round != 1 {
+		t.Errorf("stayed player told %+v, want a 1-0 forfeit win after round 1", r)
+	}
+	if stayed.scoreToken != "" {
+		t.Error("a forfeit win was issued a high score token")
+	}
+}
+
+// rematchMessages reports whether p has been told a rematch was declined,
+// or that a new series has started.
+func rematchMessages(t *testing.T, p *Player) (declined, started bool) {
+	t.Helper()
+	for len(p.send) > 0 {
+		f := <-p.send
+		msg, err := decodeFrame(f.kind, f.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch msg.(type) {
+		case RematchDeclined:
+			declined = true
+		case RoundStart:
+			started = true
+		}
+	}
+	return declined, started
+}
+
+func TestHandleRematch(t *testing.T) {
+	type answer struct {
+		seat   int
+		accept bool
+	}
+	tests := []struct {
+		name         string
+		seriesOn     bool // the series hasn't finished yet
+		alone        bool // the opponent has left
+		answers      []answer
+		wantStarted  bool
+		wantDeclined [2]bool // told by seat
+	}{
+		{"both accept", false, false, []answer{{0, true}, {1, true}}, true, [2]bool{}},
+		{"only one accepts", false, false, []answer{{0, true}}, false, [2]bool{}},
+		{"same player twice", false, false, []answer{{0, true}, {0, true}}, false, [2]bool{}},
+		{"accept then decline", false, false, []answer{{0, true}, {1, false}}, false, [2]bool{true, false}},
+		{"decline then accept", false, false, []answer{{1, false}, {0, true}}, false, [2]bool{}},
+		{"change of heart", false, false, []answer{{0, true}, {0, false}, {1, true}}, false, [2]bool{}},
+		{"opponent gone", false, true, []answer{{0, true}}, false, [2]bool{true, false}},
+		{"series still on", true, false, []answer{{0, true}, {1, true}}, false, [2]bool{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _, _ := fightingPair()
+			players := l.Players
+			l.Round, l.MatchEnded, l.SeriesOver = 1, true, !tt.seriesOn
+			if tt.alone {
+				l.Players[1] = nil
+			}
+
+			for _, a := range tt.answers {
+				handleRematch(players[a.seat], a.accept)
+			}
+
+			started := l.Round == 1 && !l.SeriesOver && !l.MatchEnded
+			if started != tt.wantStarted {
+				t.Errorf("rematch started = %v, want %v", started, tt.wantStarted)
+			}
+			for seat, p := range players {
+				declined, told := rematchMessages(t, p)
+				if declined != tt.wantDeclined[seat] {
+					t.Errorf("seat %d told declined = %v, want %v", seat, declined, tt.wantDeclined[seat])
+				}
+				if seat == 0 || !tt.alone {
+					if told != tt.wantStarted {
+						t.Errorf("seat %d sent a new round = %v, want %v", seat, told, tt.wantStarted)
+					}
+				}
+				if tt.wantStarted && p.wantsRematch {
+					t.Errorf("seat %d still marked as wanting a rematch", seat)
+				}
+			}
+		})
+	}
+}
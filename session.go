@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SessionInfo gives a player the token that reclaims their seat if their
+// connection drops mid-series.
+type SessionInfo struct {
+	Token string `json:"token"`
+}
+
+// OpponentStatus tells a player whether their opponent's seat is being
+// held while they reconnect.
+type OpponentStatus struct {
+	Reconnecting bool `json:"reconnecting"`
+}
+
+// reconnectGrace is how long a dropped player's seat is held for them.
+// Neither knight can be hurt in the meantime and the round clock stops, so
+// each player only gets maxSeatHolds of them per series; dropping again
+// forfeits. reconnectGrace is a variable so tests can shorten it.
+var reconnectGrace = 10 * time.Second
+
+const maxSeatHolds = 1
+
+// SERVER
+
+// sessions maps session tokens to their players. Guarded by lobbyMu.
+var sessions = map[string]*Player{}
+
+// startSession issues a session token to a newly connected player.
+func startSession(p *Player) {
+	token, err := newMatchToken()
+	if err != nil {
+		fmt.Println("Failed to issue session:", err)
+		return
+	}
+	lobbyMu.Lock()
+	p.session = token
+	sessions[token] = p
+	lobbyMu.Unlock()
+	p.sendMessage(SessionInfo{Token: token})
+}
+
+// holdSeat keeps a player who dropped mid-series in their seat for
+// reconnectGrace, reporting false if there's no series to come back to or
+// they've already used their holds.
+func holdSeat(p *Player) bool {
+	lobbyMu.Lock()
+	defer lobbyMu.Unlock()
+	lobby := p.Lobby
+	if lobby == nil || p.session == "" {
+		return false
+	}
+	lobby.mu.Lock()
+	defer lobby.mu.Unlock()
+	other := lobby.opponent(p)
+	if other == nil || other.away || lobby.Round == 0 || lobby.SeriesOver || p.holds >= maxSeatHolds {
+		return false
+	}
+
+	p.away = true
+	p.awayAt = time.Now()
+	p.holds++
+	other.sendMessage(OpponentStatus{Reconnecting: true})
+	fmt.Printf("Player dropped from lobby %d - holding their seat for %s\n", lobby.ID, reconnectGrace)
+	conn := p.Conn
+	time.AfterFunc(reconnectGrace, func() { expireSeat(p, conn) })
+	return true
+}
+
+// expireSeat gives up on a held seat if its player hasn't come back since
+// dropping conn.
+func expireSeat(p *Player, conn *websocket.Conn) {
+	lobbyMu.Lock()
+	lobby := p.Lobby
+	lobby.mu.Lock()
+	expired := p.away && p.Conn == conn
+	if expired {
+		// Too late to reconnect from here on
+		delete(sessions, p.session)
+	}
+	lobby.mu.Unlock()
+	lobbyMu.Unlock()
+
+	if expired {
+		fmt.Printf("Player didn't reconnect to lobby %d in time\n", lobby.ID)
+		p.leave()
+	}
+}
+
+// resumeSession puts a reconnecting player back in their held seat with
+// the HP and position they left with, reporting false if the token doesn't
+// match one or the series is already over. If the server hasn't noticed
+// the old connection is dead yet, it's closed rather than waited out. If
+// the break between rounds ran out while they were away, the next round
+// starts now. useBinary is the encoding the new connection agreed on.
+func resumeSession(c *websocket.Conn, token string, useBinary bool) bool {
+	const (
+		tries    = 20
+		tryDelay = 50 * time.Millisecond
+	)
+	for i := 0; i < tries; i++ {
+		if i > 0 {
+			time.Sleep(tryDelay)
+		}
+		lobbyMu.Lock()
+		p := sessions[token]
+		if p == nil || p.Lobby == nil {
+			lobbyMu.Unlock()
+			return false
+		}
+		lobby := p.Lobby
+		lobby.mu.Lock()
+		if !p.away {
+			if i == 0 {
+				p.Conn.Close()
+			}
+			lobby.mu.Unlock()
+			lobbyMu.Unlock()
+			continue
+		}
+
+		// Nothing to come back to if the series ended while we were away
+		if lobby.opponent(p) == nil || lobby.SeriesOver {
+			lobby.mu.Unlock()
+			lobbyMu.Unlock()
+			return false
+		}
+
+		p.attach(c)
+		p.binary = useBinary
+		p.away = false
+		lobby.resumeClock(p.awayAt)
+		// Same greeting as a new connection, then the fight as it stands
+		p.sendMessage(p.State)
+		p.sendMessage(SessionInfo{Token: token})
+		lobby.opponent(p).sendMessage(OpponentStatus{})
+		switch {
+		case lobby.roundDue:
+			// The break ran out while we were away
+			startRound(lobby)
+		case lobby.MatchEnded:
+			// Between rounds: the last result stands until the next begins
+			p.sendMessage(p.lastResult)
+		default:
+			p.sendMessage(lobby.roundStart(p))
+		}
+		fmt.Printf("Player reconnected to lobby %d\n", lobby.ID)
+		lobby.mu.Unlock()
+		lobbyMu.Unlock()
+
+		go handlePlayer(p)
+		return true
+	}
+	return false
+}
+
+// resumeClock pushes the round clock back by however long a seat has been
+// held since awayAt, since the clock doesn't run meanwhile. A player who
+// dropped during the break only stops it from when the next round began.
+// Caller must hold l.mu.
+func (l *Lobby) resumeClock(awayAt time.Time) {
+	if l.MatchEnded || l.StartTime.IsZero() {
+		return
+	}
+	if l.StartTime.After(awayAt) {
+		awayAt = l.StartTime
+	}
+	l.StartTime = l.StartTime.Add(time.Since(awayAt))
+}
+
+// CLIENT
+
+// Reconnecting and Reconnected are passed to the game, never sent, while
+// the client tries to win back its seat after losing the server.
+type (
+	Reconnecting struct{}
+	Reconnected  struct{}
+)
+
+// reconnectRetry is how often the client redials while reconnecting.
+const reconnectRetry = 500 * time.Millisecond
+
+// redial reconnects to server with a session token, retrying for as long
+// as the server would hold the seat. It returns the connection once the
+// server has greeted it, and whether it agreed to binary.
+func redial(server string, header http.Header, session string, encodings []string) (*websocket.Conn, bool, error) {
+	server = withQuery(server, "session", session)
+	deadline := time.Now().Add(reconnectGrace)
+	for {
+		c, _, err := websocket.DefaultDialer.Dial(server, header)
+		if err == nil {
+			c.SetReadDeadline(time.Now().Add(pongWait))
+			var useBinary bool
+			if _, useBinary, err = handshake(c, encodings); err == nil {
+				return c, useBinary, nil
+			}
+			c.Close()
+			var refused refusedError
+			if errors.As(err, &refused) {
+				return nil, false, err
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, false, err
+		}
+		time.Sleep(reconnectRetry)
+	}
+}
+
+// keepAlive answers the server's pings and sets a deadline for hearing
+// from it, so a dead connection is noticed. Each message read should push
+// the deadline back by pongWait.
+func keepAlive(c *websocket.Conn) {
+	c.SetReadDeadline(time.Now().Add(pongWait))
+	c.SetPingHandler(func(data string) error {
+		c.SetReadDeadline(time.Now().Add(pongWait))
+		c.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(playerWriteWait))
+		return nil
+	})
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// seatedPair seats two players mid-series in a fresh lobby, with queues
+// the tests can leave undrained.
+func seatedPair() (*Lobby, *Player, *Player) {
+	l := &Lobby{Round: 1, BestOf: 3}
+	for i := range l.Players {
+		l.Players[i] = &Player{
+			Lobby:   l,
+			session: "session",
+			send:    make(chan frame, playerQueueSize),
+			done:    make(chan struct{}),
+		}
+	}
+	return l, l.Players[0], l.Players[1]
+}
+
+func TestHoldSeat(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(l *Lobby, p, other *Player)
+		want  bool
+	}{
+		{"mid-series", func(l *Lobby, p, other *Player) {}, true},
+		{"no session", func(l *Lobby, p, other *Player) { p.session = "" }, false},
+		{"before the first round", func(l *Lobby, p, other *Player) { l.Round = 0 }, false},
+		{"series over", func(l *Lobby, p, other *Player) { l.SeriesOver = true }, false},
+		{"opponent already away", func(l *Lobby, p, other *Player) { other.away = true }, false},
+		{"alone", func(l *Lobby, p, other *Player) { l.Players[1] = nil }, false},
+		{"hold already used", func(l *Lobby, p, other *Player) { p.holds = maxSeatHolds }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, p, other := seatedPair()
+			tt.setup(l, p, other)
+			got := holdSeat(p)
+			if got != tt.want {
+				t.Errorf("holdSeat = %v, want %v", got, tt.want)
+			}
+			if p.away != tt.want {
+				t.Errorf("away = %v, want %v", p.away, tt.want)
+			}
+			// Come back so the grace timer finds nothing to expire
+			l.mu.Lock()
+			p.away = false
+			l.mu.Unlock()
+		})
+	}
+}
+
+func TestHoldSeatOncePerSeries(t *testing.T) {
+	l, p, _ := seatedPair()
+	if !holdSeat(p) {
+		t.Fatal("first drop wasn't held")
+	}
+	l.mu.Lock()
+	p.away = false
+	l.mu.Unlock()
+	if holdSeat(p) {
+		t.Fatal("second drop in the series was held")
+	}
+
+	// A new series gets its holds back
+	l.mu.Lock()
+	startSeries(l)
+	l.mu.Unlock()
+	if !holdSeat(p) {
+		t.Error("drop in a new series wasn't held")
+	}
+	l.mu.Lock()
+	p.away = false
+	l.mu.Unlock()
+}
+
+func TestResumeClock(t *testing.T) {
+	tests := []struct {
+		name      string
+		started   time.Duration // ago
+		away      time.Duration // ago
+		ended     bool
+		wantShift time.Duration
+	}{
+		{"dropped mid-round", 5 * time.Second, 2 * time.Second, false, 2 * time.Second},
+		{"dropped during the break", 500 * time.Millisecond, roundBreak, false, 500 * time.Millisecond},
+		{"round over", 5 * time.Second, 2 * time.Second, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			start := now.Add(-tt.started)
+			l := &Lobby{StartTime: start, MatchEnded: tt.ended}
+			l.resumeClock(now.Add(-tt.away))
+			shift := l.StartTime.Sub(start)
+			if shift < tt.wantShift || shift > tt.wantShift+100*time.Millisecond {
+				t.Errorf("clock moved %v, want %v", shift, tt.wantShift)
+			}
+		})
+	}
+	l := &Lobby{}
+	l.resumeClock(time.Now().Add(-time.Second))
+	if !l.StartTime.IsZero() {
+		t.Error("a round that never started got a start time")
+	}
+}
+
+// queuedMessages returns every message waiting in p's send queue.
+func queuedMessages(t *testing.T, p *Player) []interface{} {
+	t.Helper()
+	var msgs []interface{}
+	for len(p.send) > 0 {
+		f := <-p.send
+		msg, err := decodeFrame(f.kind, f.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// heldPair is a best-of-3 under way with the first player's seat held for
+// them. They've used their hold, so dropping again after coming back
+// leaves for good.
+func heldPair(t *testing.T) (*Lobby, *Player, *Player) {
+	t.Helper()
+	savedSessions, savedTotal := sessions, totalPlayers
+	t.Cleanup(func() {
+		lobbyMu.Lock()
+		sessions, totalPlayers = savedSessions, savedTotal
+		lobbyMu.Unlock()
+	})
+	sessions, totalPlayers = map[string]*Player{}, 2
+
+	l, p, other := fightingPair()
+	l.BestOf = 3
+	l.mu.Lock()
+	startSeries(l)
+	l.mu.Unlock()
+	p.session, other.session = "held", "other"
+	sessions[p.session], sessions[other.session] = p, other
+	p.away, p.awayAt, p.holds = true, time.Now(), maxSeatHolds
+	queuedMessages(t, p)
+	queuedMessages(t, other)
+	return l, p, other
+}
+
+// hangUp drops the client end of a player's connection and waits for the
+// server to let them go, so nothing they do afterwards runs into the next
+// test.
+func hangUp(t *testing.T, client *websocket.Conn) {
+	t.Helper()
+	lobbyMu.Lock()
+	online := totalPlayers
+	lobbyMu.Unlock()
+	client.Close()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		lobbyMu.Lock()
+		left := totalPlayers < online
+		lobbyMu.Unlock()
+		if left {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("player never left after hanging up")
+		}
+	}
+}
+
+func TestStartSession(t *testing.T) {
+	savedSessions := sessions
+	defer func() { sessions = savedSessions }()
+	sessions = map[string]*Player{}
+
+	p := &Player{send: make(chan frame, playerQueueSize)}
+	startSession(p)
+	if p.session == "" || sessions[p.session] != p {
+		t.Fatalf("session %q wasn't registered to the player", p.session)
+	}
+	msgs := queuedMessages(t, p)
+	if want := []interface{}{SessionInfo{Token: p.session}}; !reflect.DeepEqual(msgs, want) {
+		t.Errorf("player was sent %+v, want %+v", msgs, want)
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(l *Lobby, p, other *Player)
+		check func(t *testing.T, third interface{}, l *Lobby)
+	}{
+		{
+			name: "mid-round",
+			setup: func(l *Lobby, p, other *Player) {
+				p.State.X, p.State.Y, p.State.HP = 30, 11, 70
+				other.State.HP = 90
+				l.RoundWins = [2]int{0, 1}
+				l.Round = 2
+			},
+			check: func(t *testing.T, third interface{}, l *Lobby) {
+				rs, ok := third.(RoundStart)
+				if !ok || rs.X != 30 || rs.Y != 11 || rs.HP != 70 || rs.EnemyHP != 90 || rs.Round != 2 || rs.Wins != 0 || rs.EnemyWins != 1 {
+					t.Errorf("then %+v, want round 2 at 0-1 as it stood", third)
+				}
+			},
+		},
+		{
+			name: "during the break",
+			setup: func(l *Lobby, p, other *Player) {
+				endRound(l, other, p, false)
+			},
+			check: func(t *testing.T, third interface{}, l *Lobby) {
+				r, ok := third.(MatchResult)
+				if !ok || r.Won || r.Round != 1 || r.BestOf != 3 || r.Wins != 0 || r.EnemyWins != 1 || r.SeriesOver {
+					t.Errorf("then %+v, want the round 1 loss again", third)
+				}
+				if !l.MatchEnded || l.Round != 1 {
+					t.Error("the next round started before the break was over")
+				}
+			},
+		},
+		{
+			name: "after the break ran out",
+			setup: func(l *Lobby, p, other *Player) {
+				endRound(l, other, p, false)
+				l.roundDue = true
+			},
+			check: func(t *testing.T, third interface{}, l *Lobby) {
+				rs, ok := third.(RoundStart)
+				if !ok || rs.Round != 2 || rs.HP != 100 || rs.EnemyWins != 1 {
+					t.Errorf("then %+v, want round 2 starting", third)
+				}
+				if l.MatchEnded || l.roundDue {
+					t.Error("the round that was due didn't start")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, p, other := heldPair(t)
+			l.mu.Lock()
+			tt.setup(l, p, other)
+			l.mu.Unlock()
+			queuedMessages(t, other)
+			server, client := serverConn(t)
+
+			if !resumeSession(server, p.session, false) {
+				t.Fatal("resumeSession refused a held seat")
+			}
+			var msgs []interface{}
+			for len(msgs) < 3 {
+				msg, err := readMessage(client)
+				if err != nil {
+					t.Fatalf("after %+v: %v", msgs, err)
+				}
+				msgs = append(msgs, msg)
+			}
+			if st, ok := msgs[0].(RemoteState); !ok || st != p.State {
+				t.Errorf("first %+v, want the state left with %+v", msgs[0], p.State)
+			}
+			if info, ok := msgs[1].(SessionInfo); !ok || info.Token != p.session {
+				t.Errorf("second %+v, want the session again", msgs[1])
+			}
+			l.mu.Lock()
+			tt.check(t, msgs[2], l)
+			l.mu.Unlock()
+			if p.away {
+				t.Error("still away after reconnecting")
+			}
+			if got := queuedMessages(t, other); len(got) == 0 || got[0] != (OpponentStatus{}) {
+				t.Errorf("opponent was sent %+v, want to hear we're back first", got)
+			}
+
+			hangUp(t, client)
+		})
+	}
+}
+
+func TestResumeRefused(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		setup func(l *Lobby)
+	}{
+		{"unknown token", "unknown", func(l *Lobby) {}},
+		{"series over", "held", func(l *Lobby) { l.SeriesOver = true }},
+		{"opponent left", "held", func(l *Lobby) { l.Players[1] = nil }},
+		{"seat expired", "held", func(l *Lobby) { delete(sessions, "held") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, p, _ := heldPair(t)
+			tt.setup(l)
+			server, _ := serverConn(t)
+			if resumeSession(server, tt.token, false) {
+				t.Fatal("resumed a seat there's nothing to come back to")
+			}
+			if !p.away || p.Conn == server {
+				t.Error("refused connection was given the seat")
+			}
+		})
+	}
+}
+
+func TestExpireSeat(t *testing.T) {
+	tests := []struct {
+		name     string
+		back     bool // came back before the grace ran out
+		redialed bool // and dropped again on the new connection
+		wantGone bool
+	}{
+		{"never came back", false, false, true},
+		{"came back", true, false, false},
+		{"came back and dropped again", true, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, p, other := heldPair(t)
+			dropped, _ := serverConn(t)
+			p.Conn = dropped
+			if tt.back {
+				p.away = false
+			}
+			if tt.redialed {
+				p.Conn, _ = serverConn(t)
+				p.away = true
+			}
+
+			expireSeat(p, dropped)
+			gone := l.Players[0] != p
+			if gone != tt.wantGone {
+				t.Fatalf("player gone = %v, want %v", gone, tt.wantGone)
+			}
+			if _, ok := sessions["held"]; ok == gone {
+				t.Errorf("session kept = %v once the player was gone = %v", ok, gone)
+			}
+			results := sentResults(t, other)
+			if !tt.wantGone {
+				if len(results) != 0 {
+					t.Errorf("opponent was sent %+v for a seat still held", results)
+				}
+				return
+			}
+			if len(results) != 1 || !results[0].Won || !results[0].Forfeit || !results[0].SeriesOver {
+				t.Errorf("opponent was sent %+v, want a forfeit win", results)
+			}
+		})
+	}
+}
+
+func TestSecondDropForfeits(t *testing.T) {
+	l, p, other := heldPair(t)
+	server, client := serverConn(t)
+	// Back from the one hold this series allows
+	l.mu.Lock()
+	p.attach(server)
+	p.away = false
+	l.mu.Unlock()
+	go handlePlayer(p)
+
+	hangUp(t, client)
+	if p.away || l.Players[0] == p {
+		t.Error("second drop was held")
+	}
+	msgs := queuedMessages(t, other)
+	for _, msg := range msgs {
+		if _, ok := msg.(OpponentStatus); ok {
+			t.Errorf("opponent was told %+v, want no wait for a reconnect", msg)
+		}
+	}
+	if len(msgs) == 0 {
+		t.Fatal("opponent was sent nothing, want a forfeit win")
+	}
+	if r, ok := msgs[0].(MatchResult); !ok || !r.Won || !r.Forfeit || !r.SeriesOver {
+		t.Errorf("opponent was sent %+v, want a forfeit win", msgs[0])
+	}
+}
+
+func TestResumeClosesStaleConnection(t *testing.T) {
+	l, p, other := heldPair(t)
+	stale, staleClient := serverConn(t)
+	// Still connected as far as the server knows, with a hold to spare
+	l.mu.Lock()
+	p.attach(stale)
+	p.away, p.holds = false, 0
+	l.mu.Unlock()
+	go handlePlayer(p)
+
+	server, client := serverConn(t)
+	if !resumeSession(server, p.session, false) {
+		t.Fatal("resumeSession gave up on a seat whose old connection was still open")
+	}
+	l.mu.Lock()
+	conn, holds := p.Conn, p.holds
+	l.mu.Unlock()
+	if conn != server || holds != 1 {
+		t.Errorf("seat on the new connection = %v, holds %d; want true, 1", conn == server, holds)
+	}
+	var netErr net.Error
+	if _, _, err := staleClient.ReadMessage(); err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		t.Errorf("old connection left open: %v", err)
+	}
+	want := []interface{}{OpponentStatus{Reconnecting: true}, OpponentStatus{}}
+	if got := queuedMessages(t, other); !reflect.DeepEqual(got, want) {
+		t.Errorf("opponent was sent %+v, want %+v", got, want)
+	}
+
+	hangUp(t, client)
+}
+
+func TestRedial(t *testing.T) {
+	tests := []struct {
+		name         string
+		reply        func(c *websocket.Conn)
+		wantErr      string // in the error, "" to get a connection
+		wantAttempts int
+	}{
+		{
+			name: "server back after a failed attempt",
+			reply: func(c *websocket.Conn) {
+				writeMessage(c, Hello{Version: protocolVersion, Encoding: encodingBinary})
+				writeEncoded(c, RemoteState{X: 10, Y: 12, HP: 70}, true)
+			},
+			wantAttempts: 2,
+		},
+		{
+			name: "seat gone",
+			reply: func(c *websocket.Conn) {
+				writeMessage(c, ErrorMessage{Message: "session expired"})
+			},
+			wantErr:      "session expired",
+			wantAttempts: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			attempts := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				attempts++
+				first := attempts == 1
+				mu.Unlock()
+				// The server is still restarting the first time round
+				if first || r.URL.Query().Get("session") != "tok" {
+					http.Error(w, "unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				c, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				if _, err := readMessage(c); err != nil {
+					return
+				}
+				tt.reply(c)
+				c.ReadMessage()
+			}))
+			defer srv.Close()
+
+			c, useBinary, err := redial("ws"+strings.TrimPrefix(srv.URL, "http"), nil, "tok", []string{encodingBinary, encodingJSON})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("redial error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("redial: %v", err)
+			} else {
+				defer c.Close()
+				if !useBinary {
+					t.Error("binary agreed by the server wasn't picked up")
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if attempts != tt.wantAttempts {
+				t.Errorf("dialed %d times, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/gorilla/websocket"
+)
+
+// LobbySnapshot gives spectators the full picture of a lobby. It's sent
+// when they start watching and whenever a round starts or ends; in between
+// they get each duelist's RemoteState as it's broadcast.
+type LobbySnapshot struct {
+	LobbyID    int            `json:"lobby_id"`
+	Players    [2]RemoteState `json:"players"`
+	Seated     [2]bool        `json:"seated"`
+	Bots       [2]bool        `json:"bots"`
+	Round      int            `json:"round"`
+	BestOf     int            `json:"best_of"`
+	RoundWins  [2]int         `json:"round_wins"`
+	MatchEnded bool           `json:"match_ended"`
+	Winner     int            `json:"winner,omitempty"` // 1 or 2 once a round is decided
+}
+
+// Spectator fan-out tuning. Each spectator has its own queue and writer
+// goroutine, and one whose queue fills up is dropped, so a slow viewer
+// never holds up the lobby.
+const (
+	spectatorQueueSize = 64
+	spectatorWriteWait = 5 * time.Second
+)
+
+// SERVER
+
+// Spectator is a read-only connection watching a lobby.
+type Spectator struct {
+	Conn *websocket.Conn
+
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSpectator(c *websocket.Conn) *Spectator {
+	s := &Spectator{
+		Conn: c,
+		send: make(chan []byte, spectatorQueueSize),
+		done: make(chan struct{}),
+	}
+	go s.writeLoop()
+	return s
+}
+
+// enqueue queues a message without blocking. A spectator too far behind
+// to take it is disconnected, and enqueue reports false.
+func (s *Spectator) enqueue(msg []byte) bool {
+	select {
+	case s.send <- msg:
+		return true
+	default:
+		// Too far behind to catch up, so don't wait to flush the queue
+		s.closeOnce.Do(func() {
+			close(s.done)
+			s.Conn.Close()
+		})
+		return false
+	}
+}
+
+// close stops the writer, which closes the connection. Safe to call more
+// than once.
+func (s *Spectator) close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+func (s *Spectator) writeLoop() {
+	defer s.Conn.Close()
+	for {
+		select {
+		case msg := <-s.send:
+			s.Conn.SetWriteDeadline(time.Now().Add(spectatorWriteWait))
+			if err := s.Conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// broadcastSpectators sends v to everyone watching, dropping anyone who's
+// fallen behind. It's encoded once however many spectators there are.
+// Caller must hold l.mu.
+func (l *Lobby) broadcastSpectators(v interface{}) {
+	if len(l.Spectators) == 0 {
+		return
+	}
+	msg, err := encodeMessage(v)
+	if err != nil {
+		return
+	}
+	for s := range l.Spectators {
+		if !s.enqueue(msg) {
+			delete(l.Spectators, s)
+		}
+	}
+}
+
+// snapshot describes the lobby for spectators. winner is the player who
+// just won a round, or nil. Caller must hold l.mu.
+func (l *Lobby) snapshot(winner *Player) LobbySnapshot {
+	snap := LobbySnapshot{
+		LobbyID:    l.ID,
+		Round:      l.Round,
+		BestOf:     l.BestOf,
+		RoundWins:  l.RoundWins,
+		MatchEnded: l.MatchEnded,
+	}
+	for i, p := range l.Players {
+		if p != nil {
+			snap.Players[i] = p.State
+			snap.Seated[i] = true
+			snap.Bots[i] = p.bot
+		}
+	}
+	if winner != nil {
+		snap.Winner = l.seat(winner) + 1
+	}
+	return snap
+}
+
+// closeSpectators disconnects everyone watching an emptied lobby. Caller
+// must hold l.mu.
+func (l *Lobby) closeSpectators() {
+	for s := range l.Spectators {
+		s.close()
+	}
+	l.Spectators = nil
+}
+
+// watchLobby attaches a spectator to the lobby with the given ID, or to the
+// first lobby with a fight on if id is empty.
+func watchLobby(c *websocket.Conn, id string) {
+	lobbyMu.Lock()
+	lobby := findWatchable(id)
+	lobbyMu.Unlock()
+
+	if lobby == nil {
+		msg := "no match in progress to watch"
+		if id != "" {
+			msg = fmt.Sprintf("lobby %s not found", id)
+		}
+		writeMessage(c, ErrorMessage{Message: msg})
+		c.Close()
+		return
+	}
+
+	s := newSpectator(c)
+	lobby.mu.Lock()
+	if lobby.Players[0] == nil && lobby.Players[1] == nil {
+		// Emptied while we were looking it up
+		lobby.mu.Unlock()
+		s.close()
+		return
+	}
+	if lobby.Spectators == nil {
+		lobby.Spectators = make(map[*Spectator]struct{})
+	}
+	lobby.Spectators[s] = struct{}{}
+	if msg, err := encodeMessage(lobby.snapshot(nil)); err == nil {
+		s.enqueue(msg)
+	}
+	watching := len(lobby.Spectators)
+	lobby.mu.Unlock()
+	fmt.Printf("Spectator watching lobby %d - %d watching\n", lobby.ID, watching)
+
+	// Spectators don't send anything we act on; read only to notice when
+	// they leave
+	go func() {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				break
+			}
+		}
+		lobby.mu.Lock()
+		delete(lobby.Spectators, s)
+		lobby.mu.Unlock()
+		s.close()
+	}()
+}
+
+// findWatchable returns the public lobby with the given ID, or the first
+// public lobby with a fight on if id is empty. Private rooms can't be
+// watched, like they can't be listed. Caller must hold lobbyMu.
+func findWatchable(id string) *Lobby {
+	if id == "" {
+		for _, l := range lobbies {
+			if l.Code == "" && !l.hasOpenSlot() {
+				return l
+			}
+		}
+		return nil
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return nil
+	}
+	if l := findLobby(n); l != nil && l.Code == "" {
+		return l
+	}
+	return nil
+}
+
+// CLIENT
+
+// knight is one duelist as a spectator sees it.
+type knight struct {
+	state    RemoteState
+	seated   bool
+	buf      snapshotBuffer
+	drawX    int
+	drawY    int
+	attack   time.Time
+	hitFlash time.Time
+}
+
+// update applies a broadcast state for this knight.
+func (k *knight) update(st RemoteState) {
+	if st.HP < k.state.HP {
+		k.hitFlash = time.Now()
+	}
+	if st.Attack {
+		k.attack = time.Now()
+	}
+	if st.Facing == 0 {
+		st.Facing = k.state.Facing
+	}
+	k.state = st
+	k.seated = true
+	k.buf.push(time.Now(), st.X, st.Y)
+}
+
+// StartSpectator watches a lobby read-only until it closes or we quit.
+func StartSpectator(url string) {
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		fmt.Println("Connect error:", err)
+		return
+	}
+	defer c.Close()
+
+	msg, _, err := handshake(c, nil)
+	var refused refusedError
+	if errors.As(err, &refused) {
+		fmt.Println("Server refused connection:", err)
+		return
+	}
+	first, ok := msg.(LobbySnapshot)
+	if err != nil || !ok {
+		fmt.Println("Failed to start watching:", err)
+		return
+	}
+
+	msgChan := make(chan interface{}, spectatorQueueSize)
+	go func() {
+		defer close(msgChan)
+		for {
+			msg, err := readMessage(c)
+			if err != nil {
+				return
+			}
+			switch msg.(type) {
+			case LobbySnapshot, RemoteState:
+				msgChan <- msg
+			}
+		}
+	}()
+
+	g := &Game{screen: newScreen()}
+	defer g.screen.Fini()
+
+	w := &watcher{g: g}
+	w.apply(first)
+
+	inputChan := make(chan *tcell.EventKey, 10)
+	go func() {
+		for {
+			ev := g.screen.PollEvent()
+			if ev == nil {
+				return
+			}
+			if key, ok := ev.(*tcell.EventKey); ok {
+				inputChan <- key
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(tickRate)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-inputChan:
+			if ev.Key() == tcell.KeyEscape || ev.Key() == tcell.KeyCtrlC || ev.Key() == tcell.KeyRune && (ev.Rune() == 'q' || ev.Rune() == 'Q') {
+				return
+			}
+
+		case msg, ok := <-msgChan:
+			if !ok {
+				g.showMessage((arenaLeft+arenaRight)/2, (arenaTop+arenaBottom)/2, "Match closed", tcell.StyleDefault)
+				time.Sleep(2 * time.Second)
+				return
+			}
+			switch m := msg.(type) {
+			case LobbySnapshot:
+				w.apply(m)
+			case RemoteState:
+				i := 1
+				if m.Player1 {
+					i = 0
+				}
+				w.knights[i].update(m)
+			}
+
+		case <-ticker.C:
+			w.draw(time.Now())
+		}
+	}
+}
+
+// watcher holds what a spectator knows about the lobby it's watching.
+type watcher struct {
+	g       *Game
+	knights [2]knight
+	snap    LobbySnapshot
+}
+
+// apply resets both knights from a lobby snapshot.
+func (w *watcher) apply(snap LobbySnapshot) {
+	w.snap = snap
+	for i := range w.knights {
+		k := &w.knights[i]
+		k.seated = snap.Seated[i]
+		k.state = snap.Players[i]
+		if k.state.Facing == 0 {
+			k.state.Facing = 'd'
+			if i == 1 {
+				k.state.Facing = 'a'
+			}
+		}
+		k.buf = snapshotBuffer{}
+		k.buf.push(time.Now(), k.state.X, k.state.Y)
+	}
+}
+
+var knightColors = [2]tcell.Color{tcell.ColorBlue, tcell.ColorRed}
+var knightNames = [2]string{"Blue", "Red"}
+
+func (w *watcher) draw(now time.Time) {
+	g := w.g
+	g.screen.Clear()
+	g.drawArena()
+
+	slashDuration := 150 * time.Millisecond
+	centerX := (arenaLeft + arenaRight) / 2
+	for i := range w.knights {
+		k := &w.knights[i]
+		if !k.seated {
+			continue
+		}
+		k.drawX, k.drawY, _ = k.buf.sample(now.Add(-interpDelay))
+
+		style := tcell.StyleDefault.Foreground(knightColors[i])
+		if time.Since(k.hitFlash) < 200*time.Millisecond {
+			style = style.Foreground(tcell.ColorWhite)
+		}
+		g.drawCharacter(k.drawX, k.drawY, k.state.Facing, style)
+	}
+	// Sword slashes on top of both knights
+	for i := range w.knights {
+		k := &w.knights[i]
+		if k.seated && time.Since(k.attack) < slashDuration {
+			g.drawSword(k.drawX, k.drawY, k.state.Facing, tcell.StyleDefault.Foreground(knightColors[i]))
+		}
+	}
+
+	// HP for both sides, centered like the duelists' HUD
+	for i := range w.knights {
+		k := &w.knights[i]
+		line := fmt.Sprintf("%s: %d HP", knightNames[i], k.state.HP)
+		if w.snap.Bots[i] {
+			line = fmt.Sprintf("%s (bot): %d HP", knightNames[i], k.state.HP)
+		}
+		if !k.seated {
+			line = fmt.Sprintf("%s: waiting...", knightNames[i])
+		}
+		for j, r := range line {
+			g.screen.SetContent(centerX-len(line)/2+j, i, r, nil, tcell.StyleDefault.Foreground(knightColors[i]))
+		}
+	}
+
+	// The series score gets a row of its own, clear of the HP lines
+	header := fmt.Sprintf("Watching lobby %d", w.snap.LobbyID)
+	for i, r := range header {
+		g.screen.SetContent(arenaLeft+5+i, 0, r, nil, tcell.StyleDefault.Foreground(tcell.ColorDarkGray))
+	}
+	if w.snap.BestOf > 1 {
+		series := fmt.Sprintf("Bo%d  Round %d  %d-%d", w.snap.BestOf, w.snap.Round, w.snap.RoundWins[0], w.snap.RoundWins[1])
+		for i, r := range series {
+			g.screen.SetContent(arenaLeft+5+i, arenaTop-1, r, nil, tcell.StyleDefault.Foreground(tcell.ColorDarkGray))
+		}
+	}
+
+	if w.snap.MatchEnded && w.snap.Winner > 0 {
+		banner := fmt.Sprintf("%s WINS", knightNames[w.snap.Winner-1])
+		for i, r := range banner {
+			g.screen.SetContent(centerX-len(banner)/2+i, (arenaTop+arenaBottom)/2-4, r, nil, tcell.StyleDefault.Foreground(knightColors[w.snap.Winner-1]).Bold(true))
+		}
+	}
+
+	_, h := g.screen.Size()
+	hint := "Q to stop watching"
+	for i, r := range hint {
+		g.screen.SetContent(i, h-1, r, nil, tcell.StyleDefault.Foreground(tcell.ColorDarkGray))
+	}
+	g.screen.Show()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFindWatchable(t *testing.T) {
+	saved := lobbies
+	defer func() { lobbies = saved }()
+
+	full := func(id int, code string) *Lobby {
+		l := &Lobby{ID: id, Code: code}
+		l.Players = [2]*Player{{}, {}}
+		return l
+	}
+	private := full(1, "ABCDE")
+	waiting := &Lobby{ID: 2, Players: [2]*Player{{}}}
+	public := full(3, "")
+	lobbies = []*Lobby{private, waiting, public}
+
+	tests := []struct {
+		name string
+		id   string
+		want *Lobby
+	}{
+		{"first fight skips private rooms", "", public},
+		{"public lobby by ID", "3", public},
+		{"waiting lobby by ID", "2", waiting},
+		{"private room by ID", "1", nil},
+		{"unknown ID", "9", nil},
+		{"not a number", "ABCDE", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findWatchable(tt.id); got != tt.want {
+				t.Errorf("findWatchable(%q) = %v, want %v", tt.id, got, tt.want)
+			}
+		})
+	}
+
+	lobbies = []*Lobby{private}
+	if got := findWatchable(""); got != nil {
+		t.Errorf("with only a private room on, findWatchable picked lobby %d", got.ID)
+	}
+}
+
+func TestWatchLobbySnapshot(t *testing.T) {
+	saved := lobbies
+	defer func() { lobbies = saved }()
+	l, left, right := fightingPair()
+	l.ID, l.Round, l.BestOf, l.RoundWins = 4, 2, 3, [2]int{1, 0}
+	right.State.HP = 60
+	lobbies = []*Lobby{l}
+
+	server, client := serverConn(t)
+	watchLobby(server, strconv.Itoa(l.ID))
+	msg, err := readMessage(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, ok := msg.(LobbySnapshot)
+	if !ok {
+		t.Fatalf("spectator was sent %+v first, want a snapshot", msg)
+	}
+	want := LobbySnapshot{
+		LobbyID:   4,
+		Players:   [2]RemoteState{left.State, right.State},
+		Seated:    [2]bool{true, true},
+		Round:     2,
+		BestOf:    3,
+		RoundWins: [2]int{1, 0},
+	}
+	if snap != want {
+		t.Errorf("snapshot = %+v, want %+v", snap, want)
+	}
+
+	// Leaving takes the spectator off the lobby
+	client.Close()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		l.mu.Lock()
+		watching := len(l.Spectators)
+		l.mu.Unlock()
+		if watching == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("spectator who left is still watching")
+		}
+	}
+}
+
+func TestSlowSpectatorDropped(t *testing.T) {
+	l, sender, other := fightingPair()
+	conn, client := serverConn(t)
+	// The spectator's writer is stuck, so nothing leaves its queue
+	slow := &Spectator{Conn: conn, send: make(chan []byte, spectatorQueueSize), done: make(chan struct{})}
+	l.Spectators = map[*Spectator]struct{}{slow: {}}
+
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i <= spectatorQueueSize; i++ {
+			broadcastToLobby(l, sender, false)
+		}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(2 * time.Second):
+		t.Fatal("broadcasts held up by a spectator who isn't reading")
+	}
+
+	if got := len(other.send); got != spectatorQueueSize+1 {
+		t.Errorf("opponent was sent %d states, want all %d", got, spectatorQueueSize+1)
+	}
+	l.mu.Lock()
+	_, watching := l.Spectators[slow]
+	l.mu.Unlock()
+	if watching {
+		t.Error("slow spectator is still watching")
+	}
+	select {
+	case <-slow.done:
+	default:
+		t.Error("slow spectator wasn't closed")
+	}
+	if _, _, err := client.ReadMessage(); err == nil {
+		t.Error("slow spectator's connection is still open")
+	}
+}
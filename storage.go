@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// storageKind resolves the backend for server-side stores. An empty kind
+// uses Upstash when its credentials are set and local files otherwise, so
+// LAN hosts still get working leaderboards and ratings.
+func storageKind(kind string) string {
+	if kind != "" {
+		return kind
+	}
+	if os.Getenv("UPSTASH_REDIS_REST_URL") != "" {
+		return "upstash"
+	}
+	return "file"
+}
+
+// writeJSONFile writes v to a temp file and renames it over path so a crash
+// never leaves a half-written file behind.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readJSONFile loads path into v. A missing file isn't an error; v is left
+// untouched.
+func readJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	return nil
+}
+
+// upstashClient sends Redis commands through the Upstash REST API.
+type upstashClient struct {
+	url   string
+	token string
+}
+
+func newUpstashClient() (upstashClient, error) {
+	url := os.Getenv("UPSTASH_REDIS_REST_URL")
+	token := os.Getenv("UPSTASH_REDIS_REST_TOKEN")
+	if url == "" || token == "" {
+		return upstashClient{}, fmt.Errorf("UPSTASH_REDIS_REST_URL and UPSTASH_REDIS_REST_TOKEN must be set")
+	}
+	return upstashClient{url: url, token: token}, nil
+}
+
+func (u upstashClient) request(command []interface{}) (interface{}, error) {
+	body, _ := json.Marshal(command)
+	req, _ := http.NewRequest("POST", u.url, bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+u.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	var result struct {
+		Result interface{} `json:"result"`
+		Error  string      `json:"error"`
+	}
+	json.Unmarshal(respBody, &result)
+	if result.Error != "" {
+		return nil, errors.New(result.Error)
+	}
+	return result.Result, nil
+}